@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -21,15 +22,32 @@ func Factory(ctx context.Context, c *logical.BackendConfig) (logical.Backend, er
 type hcpBackend struct {
 	*framework.Backend
 	client *hcpClient
+
+	// serializes issuance per role where a role limits its active credentials
+	roleLocks []*locksutil.LockEntry
+
+	// serializes access to each role's service principal pool
+	poolLocks []*locksutil.LockEntry
+
+	// serializes check-out and check-in per library set
+	libraryLocks []*locksutil.LockEntry
+
+	// HCP Vault Secrets responses, when caching is enabled
+	hvsCache *hvsCache
 }
 
 func Backend(c *logical.BackendConfig) *hcpBackend {
 	var b hcpBackend
+	b.roleLocks = locksutil.CreateLocks()
+	b.poolLocks = locksutil.CreateLocks()
+	b.libraryLocks = locksutil.CreateLocks()
+	b.hvsCache = newHVSCache()
 
 	b.Backend = &framework.Backend{
-		Help:        strings.TrimSpace(helpMessage),
-		BackendType: logical.TypeLogical,
-		Invalidate:  b.invalidate,
+		Help:         strings.TrimSpace(helpMessage),
+		BackendType:  logical.TypeLogical,
+		Invalidate:   b.invalidate,
+		PeriodicFunc: b.periodicFunc,
 		PathsSpecial: &logical.Paths{
 			SealWrapStorage: []string{
 				"config", // seal wrapped with extra encryption, if possible
@@ -37,14 +55,26 @@ func Backend(c *logical.BackendConfig) *hcpBackend {
 		},
 		Paths: framework.PathAppend(
 			b.pathRoles(),
+			b.pathLibrary(),
+			b.pathLibraryCheckout(),
+			b.pathHVS(),
+			b.pathProjects(),
 			[]*framework.Path{
 				b.pathConfig(),
 				b.pathConfigRotate(),
+				b.pathRoleRevokeAll(),
 				b.pathCreds(),
+				b.pathLookup(),
+				b.pathQuota(),
 			},
 		),
 		Secrets: []*framework.Secret{
 			b.hcpServicePrincipalKey(),
+			b.hcpLibraryKey(),
+			b.hcpEphemeralProject(),
+			b.hcpWorkloadIdentity(),
+			b.hcpVaultAdminToken(),
+			b.hcpConsulToken(),
 		},
 	}
 
@@ -52,8 +82,12 @@ func Backend(c *logical.BackendConfig) *hcpBackend {
 }
 
 func (b *hcpBackend) invalidate(ctx context.Context, key string) {
-	if key == "config" {
+	switch key {
+	case "config":
 		b.client = nil
+		b.hvsCache.purge()
+	case hvsConfigStorageKey:
+		b.hvsCache.purge()
 	}
 }
 
@@ -4,11 +4,16 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/logical"
 
+	consul "github.com/hashicorp/hcp-sdk-go/clients/cloud-consul-service/stable/2021-02-04/client/consul_service"
 	iam "github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/client/iam_service"
 	service_principals "github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/client/service_principals_service"
+	organization "github.com/hashicorp/hcp-sdk-go/clients/cloud-resource-manager/stable/2019-12-10/client/organization_service"
 	project "github.com/hashicorp/hcp-sdk-go/clients/cloud-resource-manager/stable/2019-12-10/client/project_service"
+	secrets "github.com/hashicorp/hcp-sdk-go/clients/cloud-vault-secrets/stable/2023-06-13/client/secret_service"
+	vault "github.com/hashicorp/hcp-sdk-go/clients/cloud-vault-service/stable/2020-11-25/client/vault_service"
 
 	hcpClientConfig "github.com/hashicorp/hcp-sdk-go/config"
 	"github.com/hashicorp/hcp-sdk-go/httpclient"
@@ -21,6 +26,10 @@ type hcpClient struct {
 	IAM               iam.ClientService
 	ServicePrincipals service_principals.ClientService
 	Project           project.ClientService
+	Organization      organization.ClientService
+	Vault             vault.ClientService
+	Secrets           secrets.ClientService
+	Consul            consul.ClientService
 }
 
 func (b *hcpBackend) getClient(ctx context.Context, s logical.Storage) (*hcpClient, error) {
@@ -37,7 +46,7 @@ func (b *hcpBackend) getClient(ctx context.Context, s logical.Storage) (*hcpClie
 		cfg = new(hcpConfig)
 	}
 
-	b.client, err = newClient(cfg)
+	b.client, err = newClient(cfg, b.Logger().Named("http"))
 	if err != nil {
 		return nil, err
 	}
@@ -45,7 +54,7 @@ func (b *hcpBackend) getClient(ctx context.Context, s logical.Storage) (*hcpClie
 	return b.client, nil
 }
 
-func newClient(cfg *hcpConfig) (*hcpClient, error) {
+func newClient(cfg *hcpConfig, logger hclog.Logger) (*hcpClient, error) {
 	hcpProfile := &profile.UserProfile{
 		OrganizationID: cfg.OrganizationID,
 		ProjectID:      cfg.ProjectID,
@@ -72,10 +81,17 @@ func newClient(cfg *hcpConfig) (*hcpClient, error) {
 		return nil, err
 	}
 
+	// log HCP API traffic when the plugin runs at debug level
+	cl.Transport = newLoggingTransport(cl.Transport, logger)
+
 	client := &hcpClient{
 		IAM:               iam.New(cl, nil),
 		ServicePrincipals: service_principals.New(cl, nil),
 		Project:           project.New(cl, nil),
+		Organization:      organization.New(cl, nil),
+		Vault:             vault.New(cl, nil),
+		Secrets:           secrets.New(cl, nil),
+		Consul:            consul.New(cl, nil),
 	}
 
 	return client, nil
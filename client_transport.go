@@ -0,0 +1,185 @@
+package hcpsecrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const redactedValue = "<redacted>"
+
+// JSON keys whose string values are known to be safe to log. Every other
+// string value in a body is redacted, so fields added to HCP responses later
+// are not logged until they are reviewed. Keys are compared in lower case
+// without underscores, matching both snake and camel case.
+var safeKeys = map[string]struct{}{
+	"id":                 {},
+	"name":               {},
+	"description":        {},
+	"displayname":        {},
+	"resourcename":       {},
+	"resourceid":         {},
+	"parentresourcename": {},
+	"organizationid":     {},
+	"projectid":          {},
+	"clusterid":          {},
+	"clientid":           {},
+	"principalid":        {},
+	"memberid":           {},
+	"membertype":         {},
+	"roleid":             {},
+	"accessorid":         {},
+	"type":               {},
+	"scopeid":            {},
+	"scopetype":          {},
+	"state":              {},
+	"status":             {},
+	"region":             {},
+	"provider":           {},
+	"createdat":          {},
+	"updatedat":          {},
+	"expiresat":          {},
+	"etag":               {},
+	"version":            {},
+	"nextpagetoken":      {},
+	"previouspagetoken":  {},
+	"code":               {},
+	"message":            {},
+	"error":              {},
+}
+
+// loggingTransport logs HCP API requests and responses at debug level,
+// redacting credentials and key material from headers and bodies.
+type loggingTransport struct {
+	base   http.RoundTripper
+	logger hclog.Logger
+}
+
+func newLoggingTransport(base http.RoundTripper, logger hclog.Logger) http.RoundTripper {
+	return &loggingTransport{
+		base:   base,
+		logger: logger,
+	}
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.logger.IsDebug() {
+		return t.base.RoundTrip(req)
+	}
+
+	var reqBody []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		reqBody = b
+		req.Body = io.NopCloser(bytes.NewReader(b))
+	}
+
+	t.logger.Debug("hcp request",
+		"method", req.Method,
+		"url", req.URL.Redacted(),
+		"headers", redactHeaders(req.Header),
+		"body", redactBody(reqBody),
+	)
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.logger.Debug("hcp request failed", "method", req.Method, "url", req.URL.Redacted(), "duration", time.Since(start), "error", err)
+		return nil, err
+	}
+
+	var respBody []byte
+	if resp.Body != nil {
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		respBody = b
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+	}
+
+	t.logger.Debug("hcp response",
+		"method", req.Method,
+		"url", req.URL.Redacted(),
+		"status", resp.StatusCode,
+		"duration", time.Since(start),
+		"headers", redactHeaders(resp.Header),
+		"body", redactBody(respBody),
+	)
+
+	return resp, nil
+}
+
+func redactHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		switch strings.ToLower(k) {
+		case "authorization", "proxy-authorization", "cookie", "set-cookie":
+			out[k] = redactedValue
+		default:
+			out[k] = strings.Join(v, ",")
+		}
+	}
+	return out
+}
+
+// redactBody returns the body with every string value not under a safe key
+// replaced. Bodies that cannot be parsed as JSON are omitted entirely.
+func redactBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return "<non-json body omitted>"
+	}
+
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(redactValue(v)); err != nil {
+		return "<body omitted>"
+	}
+
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+func redactValue(v interface{}) interface{} {
+	return redactValueUnder(v, false)
+}
+
+// redactValueUnder redacts strings unless safe is set, and decides for each
+// object member whether its key is safe
+func redactValueUnder(v interface{}, safe bool) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, inner := range val {
+			_, ok := safeKeys[strings.ReplaceAll(strings.ToLower(k), "_", "")]
+			val[k] = redactValueUnder(inner, ok)
+		}
+		return val
+	case []interface{}:
+		for i, inner := range val {
+			val[i] = redactValueUnder(inner, safe)
+		}
+		return val
+	case string:
+		if safe {
+			return val
+		}
+		return redactedValue
+	default:
+		return v
+	}
+}
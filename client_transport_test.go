@@ -0,0 +1,111 @@
+package hcpsecrets
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRedactValue(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "service principal key",
+			in:   `{"key":{"client_id":"abc","resource_name":"iam/key"},"client_secret":"s3cret"}`,
+			want: `{"client_secret":"<redacted>","key":{"client_id":"abc","resource_name":"iam/key"}}`,
+		},
+		{
+			name: "consul root token",
+			in:   `{"acl_token":{"accessor_id":"acc","secret_id":"root"}}`,
+			want: `{"acl_token":{"accessor_id":"acc","secret_id":"<redacted>"}}`,
+		},
+		{
+			name: "consul client config",
+			in:   `{"ca_file":"Y2E=","consul_config_file":"Y29uZmln"}`,
+			want: `{"ca_file":"<redacted>","consul_config_file":"<redacted>"}`,
+		},
+		{
+			name: "vault admin token",
+			in:   `{"token":"hvs.abc"}`,
+			want: `{"token":"<redacted>"}`,
+		},
+		{
+			name: "unknown fields are redacted",
+			in:   `{"new_field":"value","nested":{"other":"value"}}`,
+			want: `{"nested":{"other":"<redacted>"},"new_field":"<redacted>"}`,
+		},
+		{
+			name: "camel case safe keys",
+			in:   `{"resourceName":"iam/sp","clientSecret":"s3cret"}`,
+			want: `{"clientSecret":"<redacted>","resourceName":"iam/sp"}`,
+		},
+		{
+			name: "arrays follow their key",
+			in:   `{"service_principals":[{"id":"1","name":"sp"}],"audiences":["a","b"]}`,
+			want: `{"audiences":["<redacted>","<redacted>"],"service_principals":[{"id":"1","name":"sp"}]}`,
+		},
+		{
+			name: "numbers and booleans are kept",
+			in:   `{"total":2,"enabled":true}`,
+			want: `{"enabled":true,"total":2}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v interface{}
+			if err := json.Unmarshal([]byte(tt.in), &v); err != nil {
+				t.Fatal(err)
+			}
+
+			var wantValue interface{}
+			if err := json.Unmarshal([]byte(tt.want), &wantValue); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := redactValue(v); !reflect.DeepEqual(got, wantValue) {
+				t.Errorf("got %v, want %v", got, wantValue)
+			}
+		})
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "empty", in: "", want: ""},
+		{name: "not json", in: "token=abc", want: "<non-json body omitted>"},
+		{name: "json", in: `{"token":"abc"}`, want: `{"token":"<redacted>"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactBody([]byte(tt.in)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	h := http.Header{
+		"Authorization": {"Bearer abc"},
+		"Content-Type":  {"application/json"},
+	}
+
+	want := map[string]string{
+		"Authorization": redactedValue,
+		"Content-Type":  "application/json",
+	}
+
+	if got := redactHeaders(h); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
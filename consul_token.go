@@ -0,0 +1,138 @@
+package hcpsecrets
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	consul "github.com/hashicorp/hcp-sdk-go/clients/cloud-consul-service/stable/2021-02-04/client/consul_service"
+)
+
+const secretTypeConsulToken = "hcp-consul-token"
+
+// what consul_token roles issue
+const (
+	consulCredentialRootToken    = "root_token"
+	consulCredentialClientConfig = "client_config"
+)
+
+func (b *hcpBackend) hcpConsulToken() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeConsulToken,
+		Fields: map[string]*framework.FieldSchema{
+			"accessor_id": {
+				Type:        framework.TypeString,
+				Description: "Accessor ID of the Consul ACL token",
+			},
+			"secret_id": {
+				Type:        framework.TypeString,
+				Description: "Secret ID of the Consul ACL token",
+			},
+			"ca_file": {
+				Type:        framework.TypeString,
+				Description: "CA certificate of the Consul cluster, for client_config roles",
+			},
+			"consul_config": {
+				Type:        framework.TypeString,
+				Description: "Consul client agent configuration, for client_config roles",
+			},
+		},
+		Revoke: b.revokeConsulToken,
+		Renew:  b.renewCredentials,
+	}
+}
+
+// issueConsulToken creates a root ACL token for, or fetches the client
+// configuration of, the role's HCP Consul Dedicated cluster in the configured project
+func (b *hcpBackend) issueConsulToken(ctx context.Context, req *logical.Request, cl *hcpClient, role *hcpRole, ttl time.Duration, requester hcpRequester, logger hclog.Logger) (*logical.Response, error) {
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	logger = logger.With("cluster_id", role.ClusterID, "consul_credential", role.ConsulCredential)
+
+	var data map[string]interface{}
+	switch role.ConsulCredential {
+	case consulCredentialClientConfig:
+		p := consul.NewGetClientConfigParams()
+		p.ID = role.ClusterID
+		p.LocationOrganizationID = cfg.OrganizationID
+		p.LocationProjectID = cfg.ProjectID
+
+		logger.Debug("fetching consul client configuration")
+		r, err := cl.Consul.GetClientConfig(p, nil)
+		if err != nil {
+			logger.Error("failed to fetch consul client configuration", "error", err)
+			return nil, err
+		}
+
+		data = map[string]interface{}{
+			"cluster_id":    role.ClusterID,
+			"ca_file":       string(r.Payload.CaFile),
+			"consul_config": string(r.Payload.ConsulConfigFile),
+		}
+	default:
+		p := consul.NewCreateCustomerMasterACLTokenParams()
+		p.ID = role.ClusterID
+		p.LocationOrganizationID = cfg.OrganizationID
+		p.LocationProjectID = cfg.ProjectID
+
+		logger.Debug("creating consul root token")
+		r, err := cl.Consul.CreateCustomerMasterACLToken(p, nil)
+		if err != nil {
+			logger.Error("failed to create consul root token", "error", err)
+			return nil, err
+		}
+
+		if r.Payload.ACLToken == nil {
+			return nil, fmt.Errorf("HCP returned no ACL token for cluster %q", role.ClusterID)
+		}
+
+		data = map[string]interface{}{
+			"cluster_id":  role.ClusterID,
+			"accessor_id": r.Payload.ACLToken.AccessorID,
+			"secret_id":   r.Payload.ACLToken.SecretID,
+		}
+	}
+
+	logger.Info("issued consul credential")
+
+	internalData := map[string]interface{}{
+		"vault_role":        role.Name,
+		"cluster_id":        role.ClusterID,
+		"consul_credential": role.ConsulCredential,
+	}
+	if accessorID, ok := data["accessor_id"]; ok {
+		internalData["accessor_id"] = accessorID
+	}
+	for k, v := range requester.internalData() {
+		internalData[k] = v
+	}
+
+	resp := b.Secret(secretTypeConsulToken).Response(data, internalData)
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = role.leaseMaxTTL()
+	resp.Secret.Renewable = role.Renewable
+
+	if role.ConsulCredential != consulCredentialClientConfig {
+		resp.AddWarning("HCP cannot revoke Consul root tokens, the token stays valid after the lease ends")
+	}
+
+	return resp, nil
+}
+
+// revokeConsulToken only records the end of the lease, as the HCP API has no
+// way to revoke root tokens or client configuration
+func (b *hcpBackend) revokeConsulToken(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.Logger().Warn("consul credential lease ended, HCP cannot revoke it and it remains valid",
+		"vault_role", req.Secret.InternalData["vault_role"],
+		"cluster_id", req.Secret.InternalData["cluster_id"],
+		"accessor_id", req.Secret.InternalData["accessor_id"],
+		"entity_id", req.Secret.InternalData["entity_id"])
+	return nil, nil
+}
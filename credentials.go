@@ -0,0 +1,311 @@
+package hcpsecrets
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	credentialsStoragePrefix     = "credentials/"
+	principalsStoragePrefix      = "principals/"
+	roleCredentialsStoragePrefix = "role-credentials/"
+
+	libraryCredentialsStoragePrefix = "library-credentials/"
+)
+
+// hcpRequester identifies the Vault caller that requested a credential
+type hcpRequester struct {
+	EntityID      string `json:"entity_id"`
+	DisplayName   string `json:"display_name"`
+	MountAccessor string `json:"mount_accessor"`
+	RequestID     string `json:"request_id"`
+
+	// Purpose is the caller's free-form label for the credential
+	Purpose string `json:"purpose,omitempty"`
+
+	// Justification and TicketID explain why a credential of a break-glass
+	// role was requested
+	Justification string `json:"justification,omitempty"`
+	TicketID      string `json:"ticket_id,omitempty"`
+}
+
+// hcpCredential is the record kept for every issued service principal key.
+// Workload identity credentials have no key and are recorded under the ID
+// of their workload identity provider instead, see recordID.
+type hcpCredential struct {
+	ClientID             string       `json:"client_id"`
+	KeyResourceName      string       `json:"key_resource_name"`
+	ServicePrincipal     string       `json:"service_principal"`
+	ServicePrincipalName string       `json:"service_principal_name"`
+	ServicePrincipalID   string       `json:"service_principal_id"`
+	VaultRole            string       `json:"vault_role"`
+	Requester            hcpRequester `json:"requester"`
+	IssuedAt             time.Time    `json:"issued_at"`
+	ExpiresAt            time.Time    `json:"expires_at"`
+
+	// Shared is set when the key was issued on a role's shared service
+	// principal, which outlives the credential
+	Shared bool `json:"shared,omitempty"`
+
+	// ProjectID is set when the credential lives outside the configured
+	// project, and EphemeralProject when that project was created for it
+	ProjectID        string `json:"project_id,omitempty"`
+	EphemeralProject bool   `json:"ephemeral_project,omitempty"`
+
+	// WorkloadIdentityProvider is the resource name of the provider federated
+	// with the service principal in place of a key, and
+	// WorkloadIdentityProviderID its ID
+	WorkloadIdentityProvider   string `json:"workload_identity_provider,omitempty"`
+	WorkloadIdentityProviderID string `json:"workload_identity_provider_id,omitempty"`
+
+	// LibrarySet is set on check-outs of a library set, which are indexed
+	// under the set instead of a role
+	LibrarySet string `json:"library_set,omitempty"`
+
+	// LeasePath is the Vault lease prefix the credential was issued under.
+	// Together with the record ID it identifies the lease. LeaseID is best-effort,
+	// as Vault only hands it to the plugin on renew.
+	LeasePath string `json:"lease_path"`
+	LeaseID   string `json:"lease_id,omitempty"`
+
+	// RevokedAt is set when the credential was revoked in HCP ahead of its
+	// lease, which can then no longer be renewed
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+}
+
+// credentialIndexEntry points from a secondary index to a credential record
+type credentialIndexEntry struct {
+	RecordID string `json:"record_id"`
+}
+
+func newRequester(req *logical.Request) hcpRequester {
+	return hcpRequester{
+		EntityID:      req.EntityID,
+		DisplayName:   req.DisplayName,
+		MountAccessor: req.MountAccessor,
+		RequestID:     req.ID,
+	}
+}
+
+// requesterFromInternalData rebuilds the requester recorded on a lease
+func requesterFromInternalData(data map[string]interface{}) hcpRequester {
+	get := func(key string) string {
+		v, _ := data[key].(string)
+		return v
+	}
+
+	return hcpRequester{
+		EntityID:      get("entity_id"),
+		DisplayName:   get("display_name"),
+		MountAccessor: get("mount_accessor"),
+		RequestID:     get("request_id"),
+		Purpose:       get("purpose"),
+		Justification: get("justification"),
+		TicketID:      get("ticket_id"),
+	}
+}
+
+func (r hcpRequester) internalData() map[string]interface{} {
+	data := map[string]interface{}{
+		"entity_id":      r.EntityID,
+		"display_name":   r.DisplayName,
+		"mount_accessor": r.MountAccessor,
+		"request_id":     r.RequestID,
+	}
+	if r.Purpose != "" {
+		data["purpose"] = r.Purpose
+	}
+	if r.Justification != "" {
+		data["justification"] = r.Justification
+	}
+	if r.TicketID != "" {
+		data["ticket_id"] = r.TicketID
+	}
+	return data
+}
+
+// logArgs returns the requester's key-value pairs for a logger
+func (r hcpRequester) logArgs() []interface{} {
+	args := []interface{}{"entity_id", r.EntityID, "request_id", r.RequestID}
+	if r.Purpose != "" {
+		args = append(args, "purpose", r.Purpose)
+	}
+	if r.Justification != "" {
+		args = append(args, "justification", r.Justification)
+	}
+	if r.TicketID != "" {
+		args = append(args, "ticket_id", r.TicketID)
+	}
+	return args
+}
+
+// nameTags returns the requester's parts of a service principal name, which
+// are shortened from the end when the name is too long. The justification
+// comes last, as it is the longest and is kept in full on the lease.
+func (r hcpRequester) nameTags() []string {
+	return []string{r.tag(), r.TicketID, r.Purpose, r.Justification}
+}
+
+// tag returns a short identifier of the requester suitable for a service principal name
+func (r hcpRequester) tag() string {
+	if r.EntityID == "" {
+		return "noentity"
+	}
+	if len(r.EntityID) > 8 {
+		return r.EntityID[:8]
+	}
+	return r.EntityID
+}
+
+func getCredential(ctx context.Context, s logical.Storage, recordID string) (*hcpCredential, error) {
+	entry, err := s.Get(ctx, credentialsStoragePrefix+recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	cred := new(hcpCredential)
+	if err := entry.DecodeJSON(&cred); err != nil {
+		return nil, fmt.Errorf("error reading credential record: %w", err)
+	}
+
+	return cred, nil
+}
+
+// getCredentialByPrincipal resolves a service principal resource name through the principal index
+func getCredentialByPrincipal(ctx context.Context, s logical.Storage, resourceName string) (*hcpCredential, error) {
+	entry, err := s.Get(ctx, principalStorageKey(resourceName))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	idx := new(credentialIndexEntry)
+	if err := entry.DecodeJSON(&idx); err != nil {
+		return nil, fmt.Errorf("error reading principal index: %w", err)
+	}
+
+	return getCredential(ctx, s, idx.RecordID)
+}
+
+// listRoleCredentials returns the record IDs of the active credentials issued by a role
+func listRoleCredentials(ctx context.Context, s logical.Storage, role string) ([]string, error) {
+	return s.List(ctx, roleCredentialsStoragePrefix+role+"/")
+}
+
+// listLibraryCredentials returns the record IDs of the active check-outs of a library set
+func listLibraryCredentials(ctx context.Context, s logical.Storage, set string) ([]string, error) {
+	return s.List(ctx, libraryCredentialsStoragePrefix+set+"/")
+}
+
+// saveCredential writes the credential record and its index entries
+func saveCredential(ctx context.Context, s logical.Storage, cred *hcpCredential) error {
+	idx := &credentialIndexEntry{RecordID: cred.recordID()}
+
+	entries := map[string]interface{}{
+		credentialsStoragePrefix + cred.recordID(): cred,
+		cred.ownerStorageKey():                     idx,
+	}
+
+	// shared service principals carry several credentials, so they are not
+	// indexed by resource name
+	if !cred.Shared {
+		entries[principalStorageKey(cred.ServicePrincipal)] = idx
+	}
+
+	for key, value := range entries {
+		entry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			return err
+		}
+		if err := s.Put(ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteCredential removes the credential record and its index entries
+func deleteCredential(ctx context.Context, s logical.Storage, cred *hcpCredential) error {
+	keys := []string{
+		cred.ownerStorageKey(),
+		credentialsStoragePrefix + cred.recordID(),
+	}
+
+	if !cred.Shared {
+		keys = append(keys, principalStorageKey(cred.ServicePrincipal))
+	}
+
+	for _, key := range keys {
+		if err := s.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revokeCredentialRecord marks a credential whose HCP resources were deleted
+// ahead of its lease as revoked. The record and its principal index entry are
+// kept until Vault revokes the lease, but it no longer counts as active for
+// its role.
+func revokeCredentialRecord(ctx context.Context, s logical.Storage, cred *hcpCredential) error {
+	cred.RevokedAt = time.Now().UTC()
+
+	entry, err := logical.StorageEntryJSON(credentialsStoragePrefix+cred.recordID(), cred)
+	if err != nil {
+		return err
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return err
+	}
+
+	return s.Delete(ctx, cred.ownerStorageKey())
+}
+
+// recordID is the key the credential is stored and indexed under: the client
+// ID of its key, or the provider ID of a workload identity credential
+func (cred *hcpCredential) recordID() string {
+	if cred.WorkloadIdentityProviderID != "" {
+		return cred.WorkloadIdentityProviderID
+	}
+	return cred.ClientID
+}
+
+// recordIDFromInternalData returns the record ID of the credential of a lease
+func recordIDFromInternalData(data map[string]interface{}) (string, bool) {
+	if id, ok := data["workload_identity_provider_id"].(string); ok {
+		return id, true
+	}
+	id, ok := data["client_id"].(string)
+	return id, ok
+}
+
+// ownerStorageKey is the index entry of the credential under the role or
+// library set it was issued by
+func (cred *hcpCredential) ownerStorageKey() string {
+	if cred.LibrarySet != "" {
+		return libraryCredentialsStoragePrefix + cred.LibrarySet + "/" + cred.recordID()
+	}
+	return roleCredentialsStoragePrefix + cred.VaultRole + "/" + cred.recordID()
+}
+
+func principalStorageKey(resourceName string) string {
+	return principalsStoragePrefix + encodeResourceName(resourceName)
+}
+
+// resource names contain slashes, so they are encoded to keep storage keys flat
+func encodeResourceName(resourceName string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(resourceName))
+}
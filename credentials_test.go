@@ -0,0 +1,176 @@
+package hcpsecrets
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRequesterNameTags(t *testing.T) {
+	tests := []struct {
+		name      string
+		requester hcpRequester
+		want      []string
+	}{
+		{
+			name:      "no entity",
+			requester: hcpRequester{},
+			want:      []string{"noentity", "", "", ""},
+		},
+		{
+			name:      "entity ID is shortened",
+			requester: hcpRequester{EntityID: "0123456789abcdef"},
+			want:      []string{"01234567", "", "", ""},
+		},
+		{
+			name:      "justification comes last",
+			requester: hcpRequester{EntityID: "abc", Purpose: "deploy", Justification: "prod outage", TicketID: "INC-42"},
+			want:      []string{"abc", "INC-42", "deploy", "prod outage"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.requester.nameTags(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCredentialStorage(t *testing.T) {
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+
+	creds := []*hcpCredential{
+		{ClientID: "ci-1", ServicePrincipal: "iam/project/p/service-principal/ci-1", VaultRole: "ci"},
+		{ClientID: "ci-prod-1", ServicePrincipal: "iam/project/p/service-principal/ci-prod-1", VaultRole: "ci-prod"},
+		{ClientID: "ci-prod-2", ServicePrincipal: "iam/project/p/service-principal/shared-0", VaultRole: "ci-prod", Shared: true},
+		{ClientID: "checkout-1", ServicePrincipal: "iam/project/p/service-principal/library-1", VaultRole: "library/ci", LibrarySet: "ci"},
+		{WorkloadIdentityProviderID: "provider-1", ServicePrincipal: "iam/project/p/service-principal/github-1", VaultRole: "github"},
+	}
+	for _, cred := range creds {
+		if err := saveCredential(ctx, s, cred); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("owner index", func(t *testing.T) {
+		tests := []struct {
+			list func(context.Context, logical.Storage, string) ([]string, error)
+			name string
+			want []string
+		}{
+			{list: listRoleCredentials, name: "ci", want: []string{"ci-1"}},
+			{list: listRoleCredentials, name: "ci-prod", want: []string{"ci-prod-1", "ci-prod-2"}},
+			{list: listRoleCredentials, name: "c", want: nil},
+			{list: listLibraryCredentials, name: "ci", want: []string{"checkout-1"}},
+			{list: listRoleCredentials, name: "github", want: []string{"provider-1"}},
+		}
+
+		for _, tt := range tests {
+			got, err := tt.list(ctx, s, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+			}
+		}
+	})
+
+	t.Run("principal index", func(t *testing.T) {
+		for _, cred := range creds {
+			got, err := getCredentialByPrincipal(ctx, s, cred.ServicePrincipal)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			switch {
+			case cred.Shared && got != nil:
+				t.Errorf("shared service principal %q is indexed", cred.ServicePrincipal)
+			case !cred.Shared && (got == nil || got.recordID() != cred.recordID()):
+				t.Errorf("got %v for %q, want record ID %q", got, cred.ServicePrincipal, cred.recordID())
+			}
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		for _, cred := range creds {
+			if err := deleteCredential(ctx, s, cred); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		keys, err := logical.CollectKeys(ctx, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 0 {
+			t.Errorf("storage not empty after deleting every credential: %q", keys)
+		}
+	})
+}
+
+func TestRevokeCredentialRecord(t *testing.T) {
+	ctx := context.Background()
+	s := &logical.InmemStorage{}
+
+	cred := &hcpCredential{ClientID: "ci-1", ServicePrincipal: "iam/project/p/service-principal/ci-1", VaultRole: "ci"}
+	if err := saveCredential(ctx, s, cred); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := revokeCredentialRecord(ctx, s, cred); err != nil {
+		t.Fatal(err)
+	}
+
+	// the credential no longer counts as active for its role
+	active, err := listRoleCredentials(ctx, s, "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 0 {
+		t.Errorf("revoked credential still listed for its role: %q", active)
+	}
+
+	// but stays resolvable, marked revoked, until its lease is revoked
+	for _, get := range []func() (*hcpCredential, error){
+		func() (*hcpCredential, error) { return getCredential(ctx, s, cred.ClientID) },
+		func() (*hcpCredential, error) { return getCredentialByPrincipal(ctx, s, cred.ServicePrincipal) },
+	} {
+		got, err := get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || got.RevokedAt.IsZero() {
+			t.Errorf("got %v, want a revoked credential record", got)
+		}
+	}
+}
+
+func TestRecordIDFromInternalData(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   map[string]interface{}
+		want   string
+		wantOK bool
+	}{
+		{name: "key", data: map[string]interface{}{"client_id": "client-1"}, want: "client-1", wantOK: true},
+		{name: "workload identity", data: map[string]interface{}{"workload_identity_provider_id": "provider-1"}, want: "provider-1", wantOK: true},
+		{name: "none", data: map[string]interface{}{"vault_role": "ci"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := recordIDFromInternalData(tt.data)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %q, %t, want %q, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package hcpsecrets
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// types of event sent on the Vault event bus
+const eventTypeCredsIssue logical.EventType = "hcp/creds-issue"
+
+// sendLeaseEvent reports a lease on the Vault event bus, with the plain
+// string and boolean values of its internal data as metadata. Vault servers
+// without events enabled reject the event, which is only logged.
+func (b *hcpBackend) sendLeaseEvent(ctx context.Context, eventType logical.EventType, internalData map[string]interface{}) {
+	metadata := make(map[string]interface{}, len(internalData))
+	for k, v := range internalData {
+		switch v.(type) {
+		case string, bool:
+			metadata[k] = v
+		}
+	}
+
+	event, err := logical.NewEvent()
+	if err == nil {
+		event.Metadata, err = structpb.NewStruct(metadata)
+	}
+	if err == nil {
+		err = b.SendEvent(ctx, eventType, event)
+	}
+	if err != nil {
+		b.Logger().Debug("failed to send event", "event_type", eventType, "error", err)
+	}
+}
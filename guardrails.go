@@ -0,0 +1,189 @@
+package hcpsecrets
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/models"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// scopes a role can issue credentials in
+const (
+	scopeConfiguredProject = "configured_project"
+	scopeOtherProjects     = "other_projects"
+	scopeEphemeralProject  = "ephemeral_project"
+	scopeCluster           = "cluster"
+
+	// scopeOrganization is only used by check-outs of organization level
+	// library service principals, roles cannot issue in it
+	scopeOrganization = "organization"
+)
+
+var (
+	validHCPRoles = []string{"admin", "contributor", "viewer"}
+	validScopes   = []string{scopeConfiguredProject, scopeOtherProjects, scopeEphemeralProject, scopeCluster, scopeOrganization}
+)
+
+var errInvalidGuardrail = errors.New("invalid guardrail")
+
+// setGuardrails applies the guardrail fields provided in data to cfg
+func setGuardrails(cfg *hcpConfig, data *framework.FieldData) error {
+	if roles, ok := data.GetOk("allowed_hcp_roles"); ok {
+		cfg.AllowedHCPRoles = normalizeList(roles.([]string))
+	}
+
+	if roles, ok := data.GetOk("denied_hcp_roles"); ok {
+		cfg.DeniedHCPRoles = normalizeList(roles.([]string))
+	}
+
+	if scopes, ok := data.GetOk("allowed_scopes"); ok {
+		cfg.AllowedScopes = normalizeList(scopes.([]string))
+	}
+
+	if allowAdmin, ok := data.GetOk("allow_admin"); ok {
+		cfg.AllowAdmin = allowAdmin.(bool)
+	}
+
+	for _, r := range append(append([]string{}, cfg.AllowedHCPRoles...), cfg.DeniedHCPRoles...) {
+		if !strutil.StrListContains(validHCPRoles, r) {
+			return fmt.Errorf("%w: HCP role %q is invalid. Valid values: `admin`, `contributor`, `viewer`", errInvalidGuardrail, r)
+		}
+	}
+
+	for _, s := range cfg.AllowedScopes {
+		if !strutil.StrListContains(validScopes, s) {
+			return fmt.Errorf("%w: scope %q is invalid. Valid values: `%s`", errInvalidGuardrail, s, strings.Join(validScopes, "`, `"))
+		}
+	}
+
+	return nil
+}
+
+func normalizeList(list []string) []string {
+	out := make([]string, 0, len(list))
+	for _, v := range list {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			out = append(out, v)
+		}
+	}
+	return strutil.RemoveDuplicates(out, false)
+}
+
+// scopes returns every scope the role can issue credentials in
+func (r *hcpRole) scopes() []string {
+	switch {
+	case !r.issuesServicePrincipal():
+		return []string{scopeCluster}
+	case r.Type == roleTypeProject:
+		return []string{scopeEphemeralProject}
+	case len(r.AllowedProjects) > 0:
+		return []string{scopeConfiguredProject, scopeOtherProjects}
+	default:
+		return []string{scopeConfiguredProject}
+	}
+}
+
+// issuesAdmin reports whether the role's credentials have admin-level access
+func (r *hcpRole) issuesAdmin() bool {
+	switch r.Type {
+	case roleTypeVaultAdminToken:
+		return true
+	case roleTypeConsulToken:
+		return r.ConsulCredential == consulCredentialRootToken
+	default:
+		return r.Role == "admin"
+	}
+}
+
+// checkRole returns an error if the role, issuing in scope, is outside the
+// guardrails of the configuration. An empty scope checks every scope the
+// role can issue in.
+func (cfg *hcpConfig) checkRole(r *hcpRole, scope string) error {
+	if r.issuesAdmin() && !cfg.AllowAdmin {
+		return fmt.Errorf("role %q issues admin-level credentials, which are refused unless allow_admin=true is set on config", r.Name)
+	}
+
+	if r.Role != "" {
+		if strutil.StrListContains(cfg.DeniedHCPRoles, r.Role) {
+			return fmt.Errorf("HCP role %q is denied by the configuration", r.Role)
+		}
+		if len(cfg.AllowedHCPRoles) > 0 && !strutil.StrListContains(cfg.AllowedHCPRoles, r.Role) {
+			return fmt.Errorf("HCP role %q is not in the configuration's allowed_hcp_roles", r.Role)
+		}
+	}
+
+	if len(cfg.AllowedScopes) == 0 {
+		return nil
+	}
+
+	scopes := []string{scope}
+	if scope == "" {
+		scopes = r.scopes()
+	}
+	for _, s := range scopes {
+		if !strutil.StrListContains(cfg.AllowedScopes, s) {
+			return fmt.Errorf("scope %q is not in the configuration's allowed_scopes", s)
+		}
+	}
+
+	return nil
+}
+
+// libraryRole describes a library service principal as a role holding the
+// most privileged basic HCP role the principal has in its project or
+// organization, so check-outs can be checked against the guardrails
+func libraryRole(cl *hcpClient, set string, sp *models.HashicorpCloudIamServicePrincipal) (*hcpRole, error) {
+	var roles []string
+
+	// project level service principals cannot read the organization policy
+	if policy, err := getOrganizationIAMPolicy(cl, sp.OrganizationID); err == nil {
+		roles = policyRoles(policy, sp.ID)
+	}
+
+	if sp.ProjectID != "" {
+		policy, err := getProjectIAMPolicy(cl, sp.ProjectID)
+		if err != nil {
+			return nil, fmt.Errorf("error reading IAM policy of project %q: %w", sp.ProjectID, err)
+		}
+		roles = append(roles, policyRoles(policy, sp.ID)...)
+	}
+
+	return &hcpRole{
+		Name: "library/" + set,
+		Role: effectiveBasicRole(roles),
+	}, nil
+}
+
+// checkIssue is checkRole for a credential issued in projectID, returned as a
+// 403 error
+func (cfg *hcpConfig) checkIssue(r *hcpRole, projectID string) error {
+	scope := r.scopes()[0]
+	if scope == scopeConfiguredProject && projectID != cfg.ProjectID {
+		scope = scopeOtherProjects
+	}
+
+	if err := cfg.checkRole(r, scope); err != nil {
+		return logical.CodedError(http.StatusForbidden, err.Error())
+	}
+
+	return nil
+}
+
+// checkCheckOut is checkIssue for a check-out of a library service principal
+// in projectID, which is empty for organization level service principals
+func (cfg *hcpConfig) checkCheckOut(r *hcpRole, projectID string) error {
+	if projectID != "" {
+		return cfg.checkIssue(r, projectID)
+	}
+
+	if err := cfg.checkRole(r, scopeOrganization); err != nil {
+		return logical.CodedError(http.StatusForbidden, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package hcpsecrets
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestConfigCheckRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     hcpConfig
+		role    hcpRole
+		scope   string
+		wantErr bool
+	}{
+		{
+			name: "no guardrails",
+			role: hcpRole{Name: "r", Role: "contributor"},
+		},
+		{
+			name:    "admin without allow_admin",
+			role:    hcpRole{Name: "r", Role: "admin"},
+			wantErr: true,
+		},
+		{
+			name: "admin with allow_admin",
+			cfg:  hcpConfig{AllowAdmin: true},
+			role: hcpRole{Name: "r", Role: "admin"},
+		},
+		{
+			name:    "vault admin token without allow_admin",
+			role:    hcpRole{Name: "r", Type: roleTypeVaultAdminToken},
+			wantErr: true,
+		},
+		{
+			name:    "consul root token without allow_admin",
+			role:    hcpRole{Name: "r", Type: roleTypeConsulToken, ConsulCredential: consulCredentialRootToken},
+			wantErr: true,
+		},
+		{
+			name: "consul client config without allow_admin",
+			role: hcpRole{Name: "r", Type: roleTypeConsulToken, ConsulCredential: consulCredentialClientConfig},
+		},
+		{
+			name:    "denied HCP role",
+			cfg:     hcpConfig{DeniedHCPRoles: []string{"contributor"}},
+			role:    hcpRole{Name: "r", Role: "contributor"},
+			wantErr: true,
+		},
+		{
+			name:    "HCP role not allowed",
+			cfg:     hcpConfig{AllowedHCPRoles: []string{"viewer"}},
+			role:    hcpRole{Name: "r", Role: "contributor"},
+			wantErr: true,
+		},
+		{
+			name: "HCP role allowed",
+			cfg:  hcpConfig{AllowedHCPRoles: []string{"viewer", "contributor"}},
+			role: hcpRole{Name: "r", Role: "contributor"},
+		},
+		{
+			name: "no HCP role skips role lists",
+			cfg:  hcpConfig{AllowedHCPRoles: []string{"viewer"}},
+			role: hcpRole{Name: "library/ci"},
+		},
+		{
+			name:    "every scope of the role is checked",
+			cfg:     hcpConfig{AllowedScopes: []string{scopeConfiguredProject}},
+			role:    hcpRole{Name: "r", Role: "viewer", AllowedProjects: []string{"prod-*"}},
+			wantErr: true,
+		},
+		{
+			name:  "only the given scope is checked",
+			cfg:   hcpConfig{AllowedScopes: []string{scopeConfiguredProject}},
+			role:  hcpRole{Name: "r", Role: "viewer", AllowedProjects: []string{"prod-*"}},
+			scope: scopeConfiguredProject,
+		},
+		{
+			name:    "ephemeral project scope not allowed",
+			cfg:     hcpConfig{AllowedScopes: []string{scopeConfiguredProject}, AllowAdmin: true},
+			role:    hcpRole{Name: "r", Role: "admin", Type: roleTypeProject},
+			wantErr: true,
+		},
+		{
+			name: "cluster scope allowed",
+			cfg:  hcpConfig{AllowedScopes: []string{scopeCluster}},
+			role: hcpRole{Name: "r", Type: roleTypeConsulToken, ConsulCredential: consulCredentialClientConfig},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.checkRole(&tt.role, tt.scope)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigCheckIssue(t *testing.T) {
+	cfg := hcpConfig{
+		ProjectID:     "configured",
+		AllowedScopes: []string{scopeConfiguredProject},
+	}
+
+	tests := []struct {
+		name      string
+		role      hcpRole
+		projectID string
+		wantErr   bool
+	}{
+		{
+			name:      "configured project",
+			role:      hcpRole{Name: "r", Role: "viewer", AllowedProjects: []string{"*"}},
+			projectID: "configured",
+		},
+		{
+			name:      "other project",
+			role:      hcpRole{Name: "r", Role: "viewer", AllowedProjects: []string{"*"}},
+			projectID: "other",
+			wantErr:   true,
+		},
+		{
+			name:      "library service principal in another project",
+			role:      hcpRole{Name: "library/ci", Role: "viewer"},
+			projectID: "other",
+			wantErr:   true,
+		},
+		{
+			name:      "ephemeral project",
+			role:      hcpRole{Name: "r", Role: "viewer", Type: roleTypeProject},
+			projectID: "new",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := cfg.checkIssue(&tt.role, tt.projectID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+
+			var coded logical.HTTPCodedError
+			if err != nil && (!errors.As(err, &coded) || coded.Code() != http.StatusForbidden) {
+				t.Errorf("got error %v, want a %d error", err, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestConfigCheckCheckOut(t *testing.T) {
+	role := hcpRole{Name: "library/ci", Role: "viewer"}
+
+	tests := []struct {
+		name      string
+		scopes    []string
+		projectID string
+		wantErr   bool
+	}{
+		{
+			name:      "project level service principal",
+			scopes:    []string{scopeOtherProjects},
+			projectID: "other",
+		},
+		{
+			name:    "organization level service principal outside other_projects",
+			scopes:  []string{scopeConfiguredProject, scopeOtherProjects},
+			wantErr: true,
+		},
+		{
+			name:   "organization level service principal",
+			scopes: []string{scopeOrganization},
+		},
+		{
+			name: "every scope allowed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := hcpConfig{ProjectID: "configured", AllowedScopes: tt.scopes}
+			err := cfg.checkCheckOut(&role, tt.projectID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
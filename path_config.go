@@ -14,6 +14,12 @@ type hcpConfig struct {
 	ProjectID      string `json:"project"`
 	ClientID       string `json:"client_id"`
 	ClientSecret   string `json:"client_secret"`
+
+	// guardrails on the HCP roles and scopes that roles may issue
+	AllowedHCPRoles []string `json:"allowed_hcp_roles,omitempty"`
+	DeniedHCPRoles  []string `json:"denied_hcp_roles,omitempty"`
+	AllowedScopes   []string `json:"allowed_scopes,omitempty"`
+	AllowAdmin      bool     `json:"allow_admin,omitempty"`
 }
 
 func (b *hcpBackend) pathConfig() *framework.Path {
@@ -46,6 +52,22 @@ func (b *hcpBackend) pathConfig() *framework.Path {
 					Sensitive: true,
 				},
 			},
+			"allowed_hcp_roles": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "HCP roles that roles may bind. Valid values: `admin`, `contributor`, `viewer`. If not set, every role is allowed.",
+			},
+			"denied_hcp_roles": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "HCP roles that roles may not bind, even if allowed by allowed_hcp_roles",
+			},
+			"allowed_scopes": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Where roles may issue credentials. Valid values: `configured_project`, `other_projects`, `ephemeral_project`, `cluster`, `organization`. `organization` only covers library check-outs of organization level service principals. If not set, every scope is allowed.",
+			},
+			"allow_admin": {
+				Type:        framework.TypeBool,
+				Description: "Allow roles to issue admin-level credentials: the `admin` HCP role, HCP Vault Dedicated admin tokens and HCP Consul Dedicated root tokens",
+			},
 		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.UpdateOperation: &framework.PathOperation{
@@ -106,6 +128,23 @@ func (b *hcpBackend) pathConfigWrite(ctx context.Context, req *logical.Request,
 		ClientSecret:   clientSecret,
 	}
 
+	// guardrails that are not provided are kept, so that rewriting the
+	// credentials cannot loosen them by accident
+	previous, err := readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		cfg.AllowedHCPRoles = previous.AllowedHCPRoles
+		cfg.DeniedHCPRoles = previous.DeniedHCPRoles
+		cfg.AllowedScopes = previous.AllowedScopes
+		cfg.AllowAdmin = previous.AllowAdmin
+	}
+
+	if err := setGuardrails(cfg, data); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
 	if err := saveConfig(ctx, req.Storage, cfg); err != nil {
 		return nil, err
 	}
@@ -121,7 +160,10 @@ func (b *hcpBackend) pathConfigPatch(ctx context.Context, req *logical.Request,
 		ClientSecret:   data.Get("client_secret").(string),
 	}
 
-	if err := patchConfig(ctx, req, cfg); err != nil {
+	if err := patchConfig(ctx, req, cfg, data); err != nil {
+		if errors.Is(err, errInvalidGuardrail) {
+			return logical.ErrorResponse(err.Error()), nil
+		}
 		return nil, err
 	}
 
@@ -141,9 +183,13 @@ func (b *hcpBackend) pathConfigRead(ctx context.Context, req *logical.Request, d
 	// do not include `client_secret` in response
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"organization": cfg.OrganizationID,
-			"project":      cfg.ProjectID,
-			"client_id":    cfg.ClientID,
+			"organization":      cfg.OrganizationID,
+			"project":           cfg.ProjectID,
+			"client_id":         cfg.ClientID,
+			"allowed_hcp_roles": cfg.AllowedHCPRoles,
+			"denied_hcp_roles":  cfg.DeniedHCPRoles,
+			"allowed_scopes":    cfg.AllowedScopes,
+			"allow_admin":       cfg.AllowAdmin,
 		},
 	}, nil
 }
@@ -154,13 +200,28 @@ func (b *hcpBackend) pathConfigDelete(ctx context.Context, req *logical.Request,
 }
 
 func getConfig(ctx context.Context, s logical.Storage) (*hcpConfig, error) {
+	cfg, err := readConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg == nil {
+		return nil, errors.New("error retrieving config: config is nil")
+	}
+
+	return cfg, nil
+}
+
+// readConfig is getConfig for callers that also work before the engine is
+// configured, it returns nil if there is no configuration
+func readConfig(ctx context.Context, s logical.Storage) (*hcpConfig, error) {
 	entry, err := s.Get(ctx, "config")
 	if err != nil {
 		return nil, err
 	}
 
 	if entry == nil {
-		return nil, errors.New("error retrieving config: config is nil")
+		return nil, nil
 	}
 
 	cfg := new(hcpConfig)
@@ -182,7 +243,9 @@ func saveConfig(ctx context.Context, s logical.Storage, cfg *hcpConfig) error {
 	return nil
 }
 
-func patchConfig(ctx context.Context, req *logical.Request, patch *hcpConfig) error {
+// patchConfig applies the non-empty fields of patch, and the guardrails in
+// data if it is set, to the stored configuration
+func patchConfig(ctx context.Context, req *logical.Request, patch *hcpConfig, data *framework.FieldData) error {
 	cfg, err := getConfig(ctx, req.Storage)
 	if err != nil {
 		return err
@@ -204,6 +267,12 @@ func patchConfig(ctx context.Context, req *logical.Request, patch *hcpConfig) er
 		cfg.ClientSecret = patch.ClientSecret
 	}
 
+	if data != nil {
+		if err := setGuardrails(cfg, data); err != nil {
+			return err
+		}
+	}
+
 	if err := saveConfig(ctx, req.Storage, cfg); err != nil {
 		return err
 	}
@@ -219,4 +288,14 @@ const pathConfigHelpDesc = `
 The HashiCorp Cloud Platform (HCP) secrets engine can create service principals
 and service principal keys at either the Organization or Project level. A configuration
 of the engine represents a single HCP Organization or Project.
+
+'allowed_hcp_roles', 'denied_hcp_roles', 'allowed_scopes' and 'allow_admin'
+limit what every role of the mount may issue. They are checked when a role is
+written and again when credentials are issued, so roles written before a change
+are also covered. Library check-outs are checked against the roles their service
+principal holds, in the 'organization' scope for organization level service
+principals, and service principal pools are not refilled for roles outside
+the guardrails. Admin-level credentials are refused unless 'allow_admin' is
+set. Guardrails that are not provided when writing the configuration keep their
+current values.
 `
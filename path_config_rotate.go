@@ -27,18 +27,25 @@ func (b *hcpBackend) pathConfigRotate() *framework.Path {
 }
 
 func (b *hcpBackend) pathConfigRotateWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	logger := b.Logger().With("operation", "rotate-root")
+
 	cl, err := b.getClient(ctx, req.Storage)
 	if err != nil {
+		logger.Error("failed to create HCP client", "error", err)
 		return nil, err
 	}
 
 	sp, spk, err := getCallerIdentity(ctx, req, cl)
 	if err != nil {
+		logger.Error("failed to look up caller identity", "error", err)
 		return nil, err
 	}
+	logger = logger.With("service_principal", sp.ResourceName)
 
+	logger.Debug("creating new root service principal key")
 	newSPK, err := createServicePrincipalKey(cl, sp)
 	if err != nil {
+		logger.Error("failed to create root service principal key", "error", err)
 		return nil, err
 	}
 
@@ -46,17 +53,21 @@ func (b *hcpBackend) pathConfigRotateWrite(ctx context.Context, req *logical.Req
 		ClientID:     newSPK.Key.ClientID,
 		ClientSecret: newSPK.ClientSecret,
 	}
-	if err := patchConfig(ctx, req, patch); err != nil {
+	if err := patchConfig(ctx, req, patch, nil); err != nil {
+		logger.Error("failed to save rotated credentials", "client_id", newSPK.Key.ClientID, "error", err)
 		return nil, err
 	}
 
 	// reset client, to load new credentials
 	b.client = nil
 
+	logger.Debug("deleting previous root service principal key", "client_id", spk.ClientID)
 	if err := deleteServicePrincipalKey(cl, spk); err != nil {
+		logger.Error("failed to delete previous root service principal key", "client_id", spk.ClientID, "error", err)
 		return nil, err
 	}
 
+	logger.Info("rotated root service principal key", "client_id", newSPK.Key.ClientID)
 	return nil, nil
 }
 
@@ -4,12 +4,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/models"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+// maximum lengths of the labels a caller can attach to a credential
+const (
+	purposeMaxLen       = 128
+	justificationMaxLen = 512
+	ticketIDMaxLen      = 64
+)
+
 func (b *hcpBackend) pathCreds() *framework.Path {
 	return &framework.Path{
 		Pattern: "creds/" + framework.GenericNameRegex("name"),
@@ -23,6 +34,36 @@ func (b *hcpBackend) pathCreds() *framework.Path {
 				Description: "Name of the role",
 				Required:    true,
 			},
+			"wait": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How long to wait for a free service principal slot when the HCP project limit is reached, at most one minute. If not set, the request fails immediately.",
+				Query:       true,
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Lease duration of the credential. Capped by the role, mount and system max TTL. If not set, the role's ttl is used.",
+				Query:       true,
+			},
+			"purpose": {
+				Type:        framework.TypeString,
+				Description: "Free-form label for what the credential is for. Recorded on the lease, in logs and events, and added to the service principal name where it fits.",
+				Query:       true,
+			},
+			"justification": {
+				Type:        framework.TypeString,
+				Description: "Why the credential is needed. Required by roles with require_justification. Recorded on the lease, in logs and events, and added to the service principal name where it fits.",
+				Query:       true,
+			},
+			"ticket_id": {
+				Type:        framework.TypeString,
+				Description: "ID of the ticket or incident the credential is requested for. Recorded on the lease, in logs and events, and added to the service principal name where it fits.",
+				Query:       true,
+			},
+			"project": {
+				Type:        framework.TypeString,
+				Description: "ID or name of the project to issue the credential in. Must match the role's allowed_projects, and cannot be set when the role sets its project. If not set, the configured project is used.",
+				Query:       true,
+			},
 		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
@@ -38,41 +79,293 @@ func (b *hcpBackend) pathCreds() *framework.Path {
 }
 
 func (b *hcpBackend) pathCredsRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	resp, err := b.issueCredentials(ctx, req, data)
+	if err != nil || resp == nil || resp.Secret == nil {
+		return resp, err
+	}
+
+	b.sendLeaseEvent(ctx, eventTypeCredsIssue, resp.Secret.InternalData)
+	return resp, nil
+}
+
+func (b *hcpBackend) issueCredentials(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	name := data.Get("name").(string)
-	entry, err := req.Storage.Get(ctx, "roles/"+name)
+	role, err := getRole(ctx, req.Storage, name)
 	if err != nil {
 		return nil, err
 	}
 
-	if entry == nil {
+	if role == nil {
 		return nil, errors.New("error retrieving role: role is nil")
 	}
 
-	role := new(hcpRole)
-	if err := entry.DecodeJSON(&role); err != nil {
-		return nil, fmt.Errorf("error reading role configuration")
+	requestedTTL := time.Duration(data.Get("ttl").(int)) * time.Second
+	if requestedTTL < 0 {
+		return logical.ErrorResponse("ttl cannot be negative"), nil
+	}
+
+	// cap the lease by the role, mount and system max TTL before creating anything in HCP
+	ttl, warnings, err := framework.CalculateTTL(b.System(), requestedTTL, role.TTL, 0, role.leaseMaxTTL(), 0, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	// count and issue under the role lock so concurrent requests cannot
+	// both take the last slot, or the last key of a shared service principal
+	var lock *locksutil.LockEntry
+	if role.MaxActiveCredentials > 0 || role.Mode == roleModeSharedPrincipal {
+		lock = locksutil.LockForKey(b.roleLocks, name)
+		lock.Lock()
+		defer lock.Unlock()
+	}
+
+	if err := checkActiveCredentials(ctx, req.Storage, role); err != nil {
+		return nil, err
+	}
+
+	requester := newRequester(req)
+	requester.Purpose = strings.TrimSpace(data.Get("purpose").(string))
+	if len(requester.Purpose) > purposeMaxLen {
+		return logical.ErrorResponse("purpose cannot be longer than %d characters", purposeMaxLen), nil
+	}
+
+	requester.Justification = strings.TrimSpace(data.Get("justification").(string))
+	requester.TicketID = strings.TrimSpace(data.Get("ticket_id").(string))
+	if role.RequireJustification && requester.Justification == "" {
+		return logical.ErrorResponse("role %q requires a justification", name), nil
+	}
+	if len(requester.Justification) > justificationMaxLen {
+		return logical.ErrorResponse("justification cannot be longer than %d characters", justificationMaxLen), nil
+	}
+	if len(requester.TicketID) > ticketIDMaxLen {
+		return logical.ErrorResponse("ticket_id cannot be longer than %d characters", ticketIDMaxLen), nil
 	}
+	logger := b.Logger().With("vault_role", name, "hcp_role", role.Role).With(requester.logArgs()...)
 
 	cl, err := b.getClient(ctx, req.Storage)
 	if err != nil {
+		logger.Error("failed to create HCP client", "error", err)
 		return nil, err
 	}
 
-	sp, err := createServicePrincipal(ctx, req, cl, role.Name)
+	cfg, err := getConfig(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
 
-	// a service principal has no role when created
-	// need to assign the newly created service principal to the role
-	if err := assignServicePrincipalRole(ctx, req, cl, sp, role.Role); err != nil {
+	projectID, err := b.credentialProject(req, cl, cfg, role, data.Get("project").(string))
+	if err != nil {
+		logger.Warn("project not available to role", "project", data.Get("project"), "error", err)
+		return nil, err
+	}
+	if projectID != cfg.ProjectID {
+		logger = logger.With("project_id", projectID)
+	}
+
+	// guardrails may have changed since the role was written
+	if err := cfg.checkIssue(role, projectID); err != nil {
+		logger.Warn("credential refused by guardrails", "error", err)
 		return nil, err
 	}
 
-	spk, err := createServicePrincipalKey(cl, sp)
+	if role.Type == roleTypeVaultAdminToken {
+		return b.issueVaultAdminToken(ctx, req, cl, role, requestedTTL, requester, logger)
+	}
+
+	if role.Type == roleTypeConsulToken {
+		resp, err := b.issueConsulToken(ctx, req, cl, role, ttl, requester, logger)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range warnings {
+			resp.AddWarning(w)
+		}
+		return resp, nil
+	}
+
+	if role.Type == roleTypeProject {
+		resp, err := b.issueEphemeralProject(ctx, req, cl, role, ttl, requester, logger)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range warnings {
+			resp.AddWarning(w)
+		}
+		return resp, nil
+	}
+
+	wait := time.Duration(data.Get("wait").(int)) * time.Second
+	if wait > maxQuotaWait {
+		wait = maxQuotaWait
+		warnings = append(warnings, fmt.Sprintf("wait is capped at %s", maxQuotaWait))
+	}
+
+	if role.Type == roleTypeWorkloadIdentity {
+		if err := b.waitForRoleServicePrincipalSlot(ctx, req, cl, role, lock, cfg.ProjectID, wait); err != nil {
+			logger.Warn("no service principal slot available", "error", err)
+			return nil, err
+		}
+
+		resp, err := b.issueWorkloadIdentity(ctx, req, cl, role, ttl, requester, logger)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range warnings {
+			resp.AddWarning(w)
+		}
+		return resp, nil
+	}
+
+	shared := role.Mode == roleModeSharedPrincipal
+
+	// a pooled service principal already exists and is bound to the role,
+	// so only a key needs to be created for it
+	pooled, err := b.takePooledServicePrincipal(ctx, req, role)
 	if err != nil {
+		logger.Error("failed to take service principal from pool", "error", err)
+		return nil, err
+	}
+
+	// until the credential is saved, a failure deletes its key and puts the
+	// pooled service principal back, or deletes the one created for it
+	var created *models.HashicorpCloudIamServicePrincipal
+	var spk *models.HashicorpCloudIamCreateServicePrincipalKeyResponse
+	saved := false
+	defer func() {
+		if saved {
+			return
+		}
+
+		if created != nil {
+			var keys []string
+			if spk != nil {
+				keys = append(keys, spk.Key.ResourceName)
+			}
+			if err := deleteServicePrincipalAndKeys(cl, created.ResourceName, keys...); err != nil {
+				logger.Error("failed to delete service principal of unissued credential", "error", err)
+			}
+			return
+		}
+
+		if spk != nil {
+			if err := deleteServicePrincipalKey(cl, spk.Key); err != nil && !isNotFound(err) {
+				// a pooled service principal with a live key is not handed out again
+				logger.Error("failed to delete key of unissued credential", "client_id", spk.Key.ClientID, "error", err)
+				return
+			}
+		}
+
+		if pooled != nil {
+			if err := b.returnPooledServicePrincipal(ctx, req, name, pooled); err != nil {
+				logger.Error("failed to return service principal to pool", "service_principal", pooled.ResourceName, "error", err)
+			}
+		}
+	}()
+
+	var sp *models.HashicorpCloudIamServicePrincipal
+	var spName string
+	switch {
+	case shared:
+		// keys are issued on the role's long-lived service principals,
+		// which stay bound to the role when a key is revoked
+		shard, err := b.acquireSharedServicePrincipal(ctx, req, cl, role, lock, wait)
+		if err != nil {
+			logger.Warn("no shared service principal available", "error", err)
+			return nil, err
+		}
+		// the role lock is released while waiting for a slot
+		if err := checkActiveCredentials(ctx, req.Storage, role); err != nil {
+			return nil, err
+		}
+		sp = &models.HashicorpCloudIamServicePrincipal{
+			ID:           shard.ID,
+			ResourceName: shard.ResourceName,
+			Name:         shard.Name,
+		}
+		spName = shard.Name
+		logger = logger.With("service_principal", sp.ResourceName)
+		logger.Debug("using shared service principal", "index", shard.Index)
+	case pooled != nil:
+		sp = &models.HashicorpCloudIamServicePrincipal{
+			ID:           pooled.ID,
+			ResourceName: pooled.ResourceName,
+			Name:         pooled.Name,
+		}
+		spName = pooled.Name
+		logger = logger.With("service_principal", sp.ResourceName)
+		logger.Debug("using pooled service principal")
+	default:
+		if err := b.waitForRoleServicePrincipalSlot(ctx, req, cl, role, lock, projectID, wait); err != nil {
+			logger.Warn("no service principal slot available", "error", err)
+			return nil, err
+		}
+
+		logger.Debug("creating service principal")
+		spName = servicePrincipalName(role.Name, requester.nameTags()...)
+		sp, err = createProjectServicePrincipal(cl, projectID, spName)
+		if err != nil {
+			logger.Error("failed to create service principal", "error", err)
+			return nil, err
+		}
+		created = sp
+		logger = logger.With("service_principal", sp.ResourceName)
+
+		// a service principal has no role when created
+		// need to assign the newly created service principal to the role
+		logger.Debug("assigning role to service principal")
+		if err := assignProjectServicePrincipalRole(cl, projectID, sp, role.Role); err != nil {
+			logger.Error("failed to assign role to service principal", "error", err)
+			return nil, err
+		}
+	}
+
+	logger.Debug("creating service principal key")
+	spk, err = createServicePrincipalKey(cl, sp)
+	if err != nil {
+		logger.Error("failed to create service principal key", "error", err)
+		return nil, err
+	}
+
+	issuedAt := time.Now().UTC()
+	cred := &hcpCredential{
+		ClientID:             spk.Key.ClientID,
+		KeyResourceName:      spk.Key.ResourceName,
+		ServicePrincipal:     sp.ResourceName,
+		ServicePrincipalName: spName,
+		ServicePrincipalID:   sp.ID,
+		VaultRole:            name,
+		Requester:            requester,
+		IssuedAt:             issuedAt,
+		ExpiresAt:            issuedAt.Add(ttl),
+		Shared:               shared,
+		LeasePath:            req.MountPoint + req.Path,
+	}
+	if projectID != cfg.ProjectID {
+		cred.ProjectID = projectID
+	}
+	if err := saveCredential(ctx, req.Storage, cred); err != nil {
+		logger.Error("failed to save credential record", "client_id", cred.ClientID, "error", err)
 		return nil, err
 	}
+	saved = true
+
+	logger.Info("issued service principal key", "client_id", spk.Key.ClientID)
+
+	internalData := map[string]interface{}{
+		"vault_role":           name,
+		"client_id":            spk.Key.ClientID,
+		"resource_name":        spk.Key.ResourceName,
+		"service_principal":    sp.ResourceName,
+		"service_principal_id": sp.ID,
+		"project_id":           projectID,
+		"created_at":           spk.Key.CreatedAt,
+	}
+	if shared {
+		internalData["shared_principal"] = true
+	}
+	for k, v := range requester.internalData() {
+		internalData[k] = v
+	}
 
 	resp := b.Secret("hcp-service-principal-key").Response(
 		// data
@@ -81,21 +374,15 @@ func (b *hcpBackend) pathCredsRead(ctx context.Context, req *logical.Request, da
 			"client_secret": spk.ClientSecret,
 		},
 		// internal data
-		map[string]interface{}{
-			"vault_role":           name,
-			"resource_name":        spk.Key.ResourceName,
-			"service_principal":    sp.ResourceName,
-			"service_principal_id": sp.ID,
-			"created_at":           spk.Key.CreatedAt,
-		},
+		internalData,
 	)
 
-	if role.TTL > 0 {
-		resp.Secret.TTL = role.TTL
-	}
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = role.leaseMaxTTL()
+	resp.Secret.Renewable = role.Renewable
 
-	if role.MaxTTL > 0 {
-		resp.Secret.MaxTTL = role.MaxTTL
+	for _, w := range warnings {
+		resp.AddWarning(w)
 	}
 
 	return resp, nil
@@ -107,23 +394,43 @@ func (b *hcpBackend) renewCredentials(ctx context.Context, req *logical.Request,
 		return nil, errors.New("internal data 'vault_role' not found")
 	}
 
-	entry, err := req.Storage.Get(ctx, "roles/"+vaultRole.(string))
+	if resp, err := checkCredentialRenewable(ctx, req); resp != nil || err != nil {
+		return resp, err
+	}
+
+	role, err := getRole(ctx, req.Storage, vaultRole.(string))
 	if err != nil {
 		return nil, err
 	}
 
-	if entry == nil {
-		return nil, errors.New("error retrieving role: role is nil")
+	// revocation does not depend on the role, so leases of a deleted role
+	// can no longer be renewed but are still cleaned up when they expire
+	if role == nil {
+		return logical.ErrorResponse("role %q no longer exists, the lease cannot be renewed", vaultRole), nil
+	}
+
+	if !role.Renewable {
+		return logical.ErrorResponse("role %q does not allow lease renewal", vaultRole), nil
 	}
 
-	role := new(hcpRole)
-	if err := entry.DecodeJSON(&role); err != nil {
-		return nil, fmt.Errorf("error reading role configuration")
+	// the lease cannot be extended past the role, mount or system max TTL
+	// measured from when it was first issued
+	ttl, warnings, err := framework.CalculateTTL(b.System(), req.Secret.Increment, role.TTL, 0, role.leaseMaxTTL(), 0, req.Secret.IssueTime)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
 	resp := &logical.Response{Secret: req.Secret}
-	resp.Secret.TTL = role.TTL
-	resp.Secret.MaxTTL = role.MaxTTL
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = role.leaseMaxTTL()
+
+	for _, w := range warnings {
+		resp.AddWarning(w)
+	}
+
+	if err := b.updateCredentialLease(ctx, req, time.Now().UTC().Add(ttl)); err != nil {
+		return nil, err
+	}
 
 	return resp, nil
 }
@@ -139,24 +446,120 @@ func (b *hcpBackend) revokeCredentials(ctx context.Context, req *logical.Request
 		return nil, errors.New("internal data 'service_principal' not found")
 	}
 
+	logger := b.Logger().With("vault_role", req.Secret.InternalData["vault_role"], "service_principal", spResourceName).With(requesterFromInternalData(req.Secret.InternalData).logArgs()...)
+
 	cl, err := b.getClient(ctx, req.Storage)
 	if err != nil {
+		logger.Error("failed to create HCP client", "error", err)
 		return nil, err
 	}
 
-	spk := &models.HashicorpCloudIamServicePrincipalKey{ResourceName: spkResourceName.(string)}
-	if err := deleteServicePrincipalKey(cl, spk); err != nil {
+	// shared service principals outlive their keys, so only the key is deleted
+	shared, _ := req.Secret.InternalData["shared_principal"].(bool)
+
+	// the key and principal may already be gone if they were removed by
+	// roles/<name>/revoke-all, in which case there is nothing left to delete
+	if shared {
+		logger.Debug("deleting service principal key", "key", spkResourceName)
+		err = deleteServicePrincipalKey(cl, &models.HashicorpCloudIamServicePrincipalKey{ResourceName: spkResourceName.(string)})
+		if isNotFound(err) {
+			err = nil
+		}
+	} else {
+		logger.Debug("deleting service principal key and service principal", "key", spkResourceName)
+		err = deleteServicePrincipalAndKeys(cl, spResourceName.(string), spkResourceName.(string))
+	}
+	if err != nil {
+		logger.Error("failed to revoke service principal key", "key", spkResourceName, "error", err)
 		return nil, err
 	}
 
-	sp := &models.HashicorpCloudIamServicePrincipal{ResourceName: spResourceName.(string)}
-	if err := deleteServicePrincipal(cl, sp); err != nil {
-		return nil, err
+	// leases issued before credential records existed have no client_id
+	if clientID, ok := req.Secret.InternalData["client_id"].(string); ok {
+		cred := &hcpCredential{
+			ClientID:         clientID,
+			ServicePrincipal: spResourceName.(string),
+			Shared:           shared,
+		}
+		cred.VaultRole, _ = req.Secret.InternalData["vault_role"].(string)
+
+		if err := deleteCredential(ctx, req.Storage, cred); err != nil {
+			logger.Error("failed to delete credential record", "client_id", clientID, "error", err)
+			return nil, err
+		}
 	}
 
+	logger.Info("revoked service principal key")
 	return nil, nil
 }
 
+// checkActiveCredentials returns a 429 error if the role has reached its
+// limit of active credentials. The caller must hold the role lock.
+func checkActiveCredentials(ctx context.Context, s logical.Storage, role *hcpRole) error {
+	if role.MaxActiveCredentials == 0 {
+		return nil
+	}
+
+	active, err := listRoleCredentials(ctx, s, role.Name)
+	if err != nil {
+		return err
+	}
+
+	if len(active) >= role.MaxActiveCredentials {
+		return logical.CodedError(http.StatusTooManyRequests, fmt.Sprintf(
+			"role %q has reached its limit of %d active credentials, wait for existing credentials to expire or revoke them",
+			role.Name, role.MaxActiveCredentials))
+	}
+
+	return nil
+}
+
+// checkCredentialRenewable returns an error response if the credential of the
+// lease was revoked in HCP ahead of the lease
+func checkCredentialRenewable(ctx context.Context, req *logical.Request) (*logical.Response, error) {
+	recordID, ok := recordIDFromInternalData(req.Secret.InternalData)
+	if !ok {
+		return nil, nil
+	}
+
+	cred, err := getCredential(ctx, req.Storage, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	if cred == nil || cred.RevokedAt.IsZero() {
+		return nil, nil
+	}
+
+	return logical.ErrorResponse("credential %q was revoked in HCP at %s, its lease cannot be renewed",
+		recordID, cred.RevokedAt.Format(time.RFC3339)), nil
+}
+
+// updateCredentialLease records the new expiry of a renewed credential and the
+// Vault lease ID, which is not known when the credential is issued
+func (b *hcpBackend) updateCredentialLease(ctx context.Context, req *logical.Request, expiresAt time.Time) error {
+	recordID, ok := recordIDFromInternalData(req.Secret.InternalData)
+	if !ok {
+		return nil
+	}
+
+	cred, err := getCredential(ctx, req.Storage, recordID)
+	if err != nil {
+		return err
+	}
+
+	if cred == nil {
+		return nil
+	}
+
+	if req.Secret.LeaseID != "" {
+		cred.LeaseID = req.Secret.LeaseID
+	}
+	cred.ExpiresAt = expiresAt
+
+	return saveCredential(ctx, req.Storage, cred)
+}
+
 const pathCredsHelpSyn = `
 Generate a dynamic, short-lived HashiCorp Cloud Platform (HCP) Service 
 Principal and Service Principal Key.
@@ -174,4 +577,22 @@ will be deleted.
 
 Service Principals can only have two Service Principal Keys.
 Projects can only have five Service Principals.
+
+The role's 'type' and 'mode' decide what is issued, see 'path-help roles/<name>'.
+
+Parameters:
+
+  ttl            Lease duration, up to the role's max TTL. Not accepted by
+                 'vault_admin_token' roles.
+  wait           How long to wait for a free service principal slot, at most
+                 one minute. Without it, a full project fails with a 429
+                 error.
+  project        Project to issue in, by ID or name, for roles with
+                 'allowed_projects'.
+  purpose        Label recorded on the lease, in logs and events, and in the
+                 service principal name.
+  justification  Reason for the request, required by roles with
+                 'require_justification'. Recorded like 'purpose', shortened
+                 in the service principal name to fit.
+  ticket_id      Ticket or incident ID, recorded like 'purpose'.
 `
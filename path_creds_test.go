@@ -0,0 +1,172 @@
+package hcpsecrets
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/models"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRenewCredentials(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+
+	if err := saveRole(ctx, s, &hcpRole{Name: "ci", Role: "viewer", Renewable: true, Mode: roleModeDynamic, Type: roleTypeServicePrincipal}); err != nil {
+		t.Fatal(err)
+	}
+
+	active := &hcpCredential{ClientID: "active", ServicePrincipal: "sp/active", VaultRole: "ci"}
+	revoked := &hcpCredential{ClientID: "revoked", ServicePrincipal: "sp/revoked", VaultRole: "ci"}
+	for _, cred := range []*hcpCredential{active, revoked} {
+		if err := saveCredential(ctx, s, cred); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := revokeCredentialRecord(ctx, s, revoked); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		clientID  string
+		role      string
+		wantError string
+	}{
+		{
+			name:     "active credential",
+			clientID: "active",
+			role:     "ci",
+		},
+		{
+			name:      "credential revoked in HCP",
+			clientID:  "revoked",
+			role:      "ci",
+			wantError: "was revoked in HCP",
+		},
+		{
+			name:      "role deleted",
+			clientID:  "active",
+			role:      "deleted",
+			wantError: "no longer exists",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.RenewOperation,
+				Storage:   s,
+				Secret: &logical.Secret{
+					LeaseOptions: logical.LeaseOptions{
+						TTL:       time.Hour,
+						Increment: time.Hour,
+						IssueTime: time.Now(),
+					},
+					InternalData: map[string]interface{}{
+						"secret_type": "hcp-service-principal-key",
+						"vault_role":  tt.role,
+						"client_id":   tt.clientID,
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantError != "" {
+				if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), tt.wantError) {
+					t.Fatalf("got %v, want an error containing %q", resp, tt.wantError)
+				}
+				return
+			}
+
+			if resp == nil || resp.IsError() || resp.Secret == nil {
+				t.Fatalf("got %v, want a renewed secret", resp)
+			}
+		})
+	}
+}
+
+func TestIssueCredentialsCleanup(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		poolSize int
+	}{
+		{name: "new service principal", poolSize: 0},
+		{name: "pooled service principal", poolSize: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, s := getTestBackend(t)
+
+			entry, err := logical.StorageEntryJSON("config", &hcpConfig{OrganizationID: "org", ProjectID: "project"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put(ctx, entry); err != nil {
+				t.Fatal(err)
+			}
+
+			fake := newFakeServicePrincipalService()
+			fake.fail["create_key"] = errors.New("key limit reached")
+			b.client = &hcpClient{ServicePrincipals: fake, Project: &fakeProjectService{}}
+
+			role := &hcpRole{Name: "ci", Role: "viewer", Renewable: true, Mode: roleModeDynamic, Type: roleTypeServicePrincipal, PoolSize: tt.poolSize}
+			if err := saveRole(ctx, s, role); err != nil {
+				t.Fatal(err)
+			}
+
+			var pooled *models.HashicorpCloudIamServicePrincipal
+			if tt.poolSize > 0 {
+				pooled = fake.addPrincipal("project", "vault-ci-pool", 0)
+				if err := savePooledServicePrincipal(ctx, s, "ci", &pooledServicePrincipal{
+					ID:           pooled.ID,
+					ResourceName: pooled.ResourceName,
+					Name:         pooled.Name,
+					HCPRole:      "viewer",
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err = b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "creds/ci",
+				Storage:   s,
+			})
+			if err == nil || !strings.Contains(err.Error(), "key limit reached") {
+				t.Fatalf("got error %v, want the key creation error", err)
+			}
+
+			pool, err := listPool(ctx, s, "ci")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pooled != nil {
+				// the pooled service principal is handed out again by the next request
+				if len(pool) != 1 || pool[0].ResourceName != pooled.ResourceName {
+					t.Errorf("got pool %v, want %q returned to it", pool, pooled.ResourceName)
+				}
+				if n := fake.keyCount(pooled.ResourceName); n != 0 {
+					t.Errorf("got %d keys on the pooled service principal, want 0", n)
+				}
+				return
+			}
+
+			if len(pool) != 0 {
+				t.Errorf("got pool %v, want it empty", pool)
+			}
+			if n := len(fake.principals); n != 0 {
+				t.Errorf("got %d service principals, want the new one deleted", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package hcpsecrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	secrets "github.com/hashicorp/hcp-sdk-go/clients/cloud-vault-secrets/stable/2023-06-13/client/secret_service"
+)
+
+const hvsConfigStorageKey = "config/hvs"
+
+const defaultHVSCacheTTL = 5 * time.Minute
+
+// hcpHVSConfig controls how HCP Vault Secrets responses are cached
+type hcpHVSConfig struct {
+	CacheEnabled bool          `json:"cache_enabled"`
+	CacheTTL     time.Duration `json:"cache_ttl"`
+}
+
+// hvsCache keeps HCP Vault Secrets responses in memory only, so secret
+// values are never written to Vault storage
+type hvsCache struct {
+	mu      sync.Mutex
+	entries map[string]hvsCacheEntry
+}
+
+type hvsCacheEntry struct {
+	data      map[string]interface{}
+	expiresAt time.Time
+}
+
+func newHVSCache() *hvsCache {
+	return &hvsCache{entries: make(map[string]hvsCacheEntry)}
+}
+
+// get returns a copy of a cached entry, as Vault may modify response data
+// after it is returned
+func (c *hvsCache) get(key string) (map[string]interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return maps.Clone(e.data), true
+}
+
+func (c *hvsCache) put(key string, data map[string]interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = hvsCacheEntry{data: maps.Clone(data), expiresAt: time.Now().Add(ttl)}
+}
+
+func (c *hvsCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]hvsCacheEntry)
+}
+
+func (b *hcpBackend) pathHVS() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "config/hvs",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefix,
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"cache_enabled": {
+					Type:        framework.TypeBool,
+					Description: "Cache HCP Vault Secrets responses in memory",
+				},
+				"cache_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "How long cached HCP Vault Secrets responses are served. Defaults to 5 minutes.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathHVSConfigWrite,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "hvs-configuration",
+					},
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathHVSConfigRead,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "hvs-configuration",
+					},
+				},
+			},
+			HelpSynopsis:    pathHVSConfigHelpSyn,
+			HelpDescription: pathHVSConfigHelpDesc,
+		},
+		{
+			Pattern: "hvs/?",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefix,
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathHVSAppsList,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "hvs-apps",
+					},
+				},
+			},
+			HelpSynopsis:    pathHVSHelpSyn,
+			HelpDescription: pathHVSHelpDesc,
+		},
+		{
+			Pattern: "hvs/" + framework.GenericNameRegex("app") + "/?",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefix,
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"app": {
+					Type:        framework.TypeString,
+					Description: "Name of the HCP Vault Secrets app",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathHVSSecretsList,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "hvs-secrets",
+					},
+				},
+			},
+			HelpSynopsis:    pathHVSHelpSyn,
+			HelpDescription: pathHVSHelpDesc,
+		},
+		{
+			Pattern: "hvs/" + framework.GenericNameRegex("app") + "/" + framework.GenericNameRegex("secret"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefix,
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"app": {
+					Type:        framework.TypeString,
+					Description: "Name of the HCP Vault Secrets app",
+					Required:    true,
+				},
+				"secret": {
+					Type:        framework.TypeString,
+					Description: "Name of the secret in the app",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathHVSSecretRead,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "hvs-secret",
+					},
+				},
+			},
+			HelpSynopsis:    pathHVSHelpSyn,
+			HelpDescription: pathHVSHelpDesc,
+		},
+	}
+}
+
+func (b *hcpBackend) pathHVSConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, err := getHVSConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if enabled, ok := data.GetOk("cache_enabled"); ok {
+		cfg.CacheEnabled = enabled.(bool)
+	}
+
+	if ttl, ok := data.GetOk("cache_ttl"); ok {
+		cfg.CacheTTL = time.Duration(ttl.(int)) * time.Second
+	}
+
+	if cfg.CacheTTL < 0 {
+		return logical.ErrorResponse("cache_ttl cannot be negative"), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(hvsConfigStorageKey, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	b.hvsCache.purge()
+	return nil, nil
+}
+
+func (b *hcpBackend) pathHVSConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, err := getHVSConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"cache_enabled": cfg.CacheEnabled,
+			"cache_ttl":     cfg.CacheTTL.Seconds(),
+		},
+	}, nil
+}
+
+func (b *hcpBackend) pathHVSAppsList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	p := secrets.NewListAppsParams()
+	p.LocationOrganizationID = cfg.OrganizationID
+	p.LocationProjectID = cfg.ProjectID
+
+	r, err := cl.Secrets.ListApps(p, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(r.Payload.Apps))
+	info := make(map[string]interface{}, len(r.Payload.Apps))
+	for _, app := range r.Payload.Apps {
+		keys = append(keys, app.Name+"/")
+		info[app.Name+"/"] = map[string]interface{}{
+			"description": app.Description,
+		}
+	}
+	sort.Strings(keys)
+
+	return logical.ListResponseWithInfo(keys, info), nil
+}
+
+func (b *hcpBackend) pathHVSSecretsList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	p := secrets.NewListAppSecretsParams()
+	p.AppName = data.Get("app").(string)
+	p.LocationOrganizationID = cfg.OrganizationID
+	p.LocationProjectID = cfg.ProjectID
+
+	r, err := cl.Secrets.ListAppSecrets(p, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(r.Payload.Secrets))
+	info := make(map[string]interface{}, len(r.Payload.Secrets))
+	for _, secret := range r.Payload.Secrets {
+		keys = append(keys, secret.Name)
+		info[secret.Name] = map[string]interface{}{
+			"latest_version": secret.LatestVersion,
+			"created_at":     secret.CreatedAt.String(),
+		}
+	}
+	sort.Strings(keys)
+
+	return logical.ListResponseWithInfo(keys, info), nil
+}
+
+func (b *hcpBackend) pathHVSSecretRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	app := data.Get("app").(string)
+	name := data.Get("secret").(string)
+
+	hvsCfg, err := getHVSConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// scoped by location so a cached secret is never served after the
+	// configuration moves to another organization or project
+	cacheKey := cfg.OrganizationID + "/" + cfg.ProjectID + "/" + app + "/" + name
+	if hvsCfg.CacheEnabled {
+		if cached, ok := b.hvsCache.get(cacheKey); ok {
+			return &logical.Response{Data: cached}, nil
+		}
+	}
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	p := secrets.NewOpenAppSecretParams()
+	p.AppName = app
+	p.SecretName = name
+	p.LocationOrganizationID = cfg.OrganizationID
+	p.LocationProjectID = cfg.ProjectID
+
+	r, err := cl.Secrets.OpenAppSecret(p, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		b.Logger().Error("failed to open HCP Vault Secrets secret", "app", app, "secret", name, "error", err)
+		return nil, err
+	}
+
+	secret := r.Payload.Secret
+	if secret == nil || secret.Version == nil {
+		return nil, errors.New("HCP Vault Secrets returned no secret version")
+	}
+
+	result := map[string]interface{}{
+		"app":        app,
+		"name":       secret.Name,
+		"value":      secret.Version.Value,
+		"version":    secret.Version.Version,
+		"type":       secret.Version.Type,
+		"created_at": secret.Version.CreatedAt.String(),
+	}
+
+	if hvsCfg.CacheEnabled {
+		b.hvsCache.put(cacheKey, result, hvsCfg.cacheTTL())
+	}
+
+	return &logical.Response{Data: result}, nil
+}
+
+func (c *hcpHVSConfig) cacheTTL() time.Duration {
+	if c.CacheTTL == 0 {
+		return defaultHVSCacheTTL
+	}
+	return c.CacheTTL
+}
+
+func getHVSConfig(ctx context.Context, s logical.Storage) (*hcpHVSConfig, error) {
+	entry, err := s.Get(ctx, hvsConfigStorageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(hcpHVSConfig)
+	if entry == nil {
+		return cfg, nil
+	}
+
+	if err := entry.DecodeJSON(&cfg); err != nil {
+		return nil, fmt.Errorf("error reading HCP Vault Secrets configuration: %w", err)
+	}
+
+	return cfg, nil
+}
+
+const pathHVSConfigHelpSyn = `
+Configure caching of HashiCorp Cloud Platform (HCP) Vault Secrets responses.
+`
+
+const pathHVSConfigHelpDesc = `
+When 'cache_enabled' is set, secrets read through 'hvs/<app>/<secret>' are kept
+in memory for 'cache_ttl' and served without calling HCP. Cached values are never
+written to Vault storage. Entries are kept per organization and project, so a
+change to 'config' never serves secrets of the previous project. Writing this
+path clears the cache.
+`
+
+const pathHVSHelpSyn = `
+Read secrets from HashiCorp Cloud Platform (HCP) Vault Secrets apps.
+`
+
+const pathHVSHelpDesc = `
+These paths list the HCP Vault Secrets apps in the configured organization and
+project, list the secrets in an app, and read the latest version of a secret,
+using the plugin's HCP credentials. Access to apps and secrets is controlled by
+Vault policies on 'hvs/<app>' and 'hvs/<app>/<secret>'.
+`
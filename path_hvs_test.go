@@ -0,0 +1,29 @@
+package hcpsecrets
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHVSCacheCopies(t *testing.T) {
+	c := newHVSCache()
+
+	data := map[string]interface{}{"value": "secret"}
+	c.put("app/secret", data, time.Minute)
+
+	// changing the stored map or a returned copy leaves the cache untouched
+	data["value"] = "changed"
+	first, ok := c.get("app/secret")
+	if !ok {
+		t.Fatal("cached entry not found")
+	}
+	first["value"] = "changed"
+
+	second, ok := c.get("app/secret")
+	if !ok {
+		t.Fatal("cached entry not found")
+	}
+	if second["value"] != "secret" {
+		t.Errorf("got %q, want the cached value unchanged", second["value"])
+	}
+}
@@ -0,0 +1,425 @@
+package hcpsecrets
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	libraryStoragePrefix         = "library/"
+	libraryCheckoutStoragePrefix = "library-checkout/"
+)
+
+// hcpLibrarySet is a set of existing, long-lived service principals that are
+// checked out exclusively with a new key and returned on check-in
+type hcpLibrarySet struct {
+	Name              string        `json:"name"`
+	ServicePrincipals []string      `json:"service_principals"`
+	TTL               time.Duration `json:"ttl,omitempty"`
+	MaxTTL            time.Duration `json:"max_ttl,omitempty"`
+
+	DisableCheckInEnforcement bool `json:"disable_check_in_enforcement"`
+}
+
+// hcpLibraryCheckout records which caller holds a service principal of a set
+type hcpLibraryCheckout struct {
+	ServicePrincipal string    `json:"service_principal"`
+	ClientID         string    `json:"client_id"`
+	KeyResourceName  string    `json:"key_resource_name"`
+	EntityID         string    `json:"entity_id"`
+	CheckedOutAt     time.Time `json:"checked_out_at"`
+
+	// TokenAccessor identifies the caller of check-outs made without an
+	// entity, such as with root or orphan tokens
+	TokenAccessor string `json:"token_accessor,omitempty"`
+}
+
+// heldBy reports whether the check-out was made by the caller of req
+func (c *hcpLibraryCheckout) heldBy(req *logical.Request) bool {
+	if c.EntityID != "" {
+		return c.EntityID == req.EntityID
+	}
+	return c.TokenAccessor != "" && c.TokenAccessor == req.ClientTokenAccessor
+}
+
+func (b *hcpBackend) pathLibrary() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "library/" + framework.GenericNameRegex("name"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefix,
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the set",
+					Required:    true,
+				},
+				"service_principals": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Resource names of the existing service principals that can be checked out",
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Default lease for checked out credentials. If not set or set to 0, will use mount/system default.",
+				},
+				"max_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Maximum time a service principal can be checked out. If not set or set to 0, will use mount/system default.",
+				},
+				"disable_check_in_enforcement": {
+					Type:        framework.TypeBool,
+					Description: "Allow any caller with access to check-in to return a service principal, not only the entity that checked it out.",
+				},
+			},
+			ExistenceCheck: b.pathLibraryExistenceCheck,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathLibraryWrite,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "library-set",
+					},
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathLibraryWrite,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "library-set",
+					},
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathLibraryRead,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "library-set",
+					},
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathLibraryDelete,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "library-set",
+					},
+				},
+			},
+			HelpSynopsis:    pathLibraryHelpSyn,
+			HelpDescription: pathLibraryHelpDesc,
+		},
+		{
+			Pattern: "library/?",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefix,
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathLibraryList,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "library-sets",
+					},
+				},
+			},
+			HelpSynopsis:    pathLibraryListHelpSyn,
+			HelpDescription: pathLibraryListHelpDesc,
+		},
+		{
+			Pattern: "library/" + framework.GenericNameRegex("name") + "/credentials/?",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefix,
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the set",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathLibraryCredentialsList,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "library-credentials",
+					},
+				},
+			},
+			HelpSynopsis:    pathLibraryCredentialsListHelpSyn,
+			HelpDescription: pathLibraryCredentialsListHelpDesc,
+		},
+	}
+}
+
+func (b *hcpBackend) pathLibraryExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
+	set, err := getLibrarySet(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return set != nil, nil
+}
+
+func (b *hcpBackend) pathLibraryWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	lock := b.libraryLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	set, err := getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if set == nil {
+		set = &hcpLibrarySet{Name: name}
+	}
+
+	if sps, ok := data.GetOk("service_principals"); ok {
+		set.ServicePrincipals = sps.([]string)
+	}
+
+	if ttl, ok := data.GetOk("ttl"); ok {
+		set.TTL = time.Duration(ttl.(int)) * time.Second
+	}
+
+	if maxTTL, ok := data.GetOk("max_ttl"); ok {
+		set.MaxTTL = time.Duration(maxTTL.(int)) * time.Second
+	}
+
+	if disable, ok := data.GetOk("disable_check_in_enforcement"); ok {
+		set.DisableCheckInEnforcement = disable.(bool)
+	}
+
+	if len(set.ServicePrincipals) == 0 {
+		return logical.ErrorResponse("service_principals is empty"), nil
+	}
+
+	if set.MaxTTL != 0 && set.TTL > set.MaxTTL {
+		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
+	}
+
+	// service principals cannot be removed from a set while checked out
+	checkouts, err := listLibraryCheckouts(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range checkouts {
+		if !strutil.StrListContains(set.ServicePrincipals, c.ServicePrincipal) {
+			return logical.ErrorResponse("service principal %q is checked out and cannot be removed from the set", c.ServicePrincipal), nil
+		}
+	}
+
+	// every service principal must belong to a single set
+	others, err := req.Storage.List(ctx, libraryStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range others {
+		if other == name {
+			continue
+		}
+		otherSet, err := getLibrarySet(ctx, req.Storage, other)
+		if err != nil {
+			return nil, err
+		}
+		if otherSet == nil {
+			continue
+		}
+		for _, sp := range set.ServicePrincipals {
+			if strutil.StrListContains(otherSet.ServicePrincipals, sp) {
+				return logical.ErrorResponse("service principal %q already belongs to set %q", sp, other), nil
+			}
+		}
+	}
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sp := range set.ServicePrincipals {
+		if _, err := getServicePrincipal(cl, sp); err != nil {
+			return logical.ErrorResponse("error looking up service principal %q: %s", sp, err), nil
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(libraryStoragePrefix+name, set)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *hcpBackend) pathLibraryRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	set, err := getLibrarySet(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if set == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"name":                         set.Name,
+			"service_principals":           set.ServicePrincipals,
+			"ttl":                          set.TTL.Seconds(),
+			"max_ttl":                      set.MaxTTL.Seconds(),
+			"disable_check_in_enforcement": set.DisableCheckInEnforcement,
+		},
+	}, nil
+}
+
+func (b *hcpBackend) pathLibraryDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	lock := b.libraryLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	checkouts, err := listLibraryCheckouts(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(checkouts) > 0 {
+		return logical.ErrorResponse("set %q has %d service principals checked out, check them in before deleting the set", name, len(checkouts)), nil
+	}
+
+	err = req.Storage.Delete(ctx, libraryStoragePrefix+name)
+	return nil, err
+}
+
+func (b *hcpBackend) pathLibraryList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List(ctx, libraryStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(entries), nil
+}
+
+func (b *hcpBackend) pathLibraryCredentialsList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	clientIDs, err := listLibraryCredentials(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	return credentialListResponse(ctx, req.Storage, clientIDs)
+}
+
+func getLibrarySet(ctx context.Context, s logical.Storage, name string) (*hcpLibrarySet, error) {
+	entry, err := s.Get(ctx, libraryStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	set := new(hcpLibrarySet)
+	if err := entry.DecodeJSON(&set); err != nil {
+		return nil, fmt.Errorf("error reading library set configuration")
+	}
+
+	return set, nil
+}
+
+func listLibraryCheckouts(ctx context.Context, s logical.Storage, set string) ([]*hcpLibraryCheckout, error) {
+	keys, err := s.List(ctx, libraryCheckoutStoragePrefix+set+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	checkouts := make([]*hcpLibraryCheckout, 0, len(keys))
+	for _, key := range keys {
+		entry, err := s.Get(ctx, libraryCheckoutStoragePrefix+set+"/"+key)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+
+		c := new(hcpLibraryCheckout)
+		if err := entry.DecodeJSON(&c); err != nil {
+			return nil, fmt.Errorf("error reading library check-out: %w", err)
+		}
+		checkouts = append(checkouts, c)
+	}
+
+	return checkouts, nil
+}
+
+func getLibraryCheckout(ctx context.Context, s logical.Storage, set string, sp string) (*hcpLibraryCheckout, error) {
+	entry, err := s.Get(ctx, libraryCheckoutStorageKey(set, sp))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	c := new(hcpLibraryCheckout)
+	if err := entry.DecodeJSON(&c); err != nil {
+		return nil, fmt.Errorf("error reading library check-out: %w", err)
+	}
+
+	return c, nil
+}
+
+func saveLibraryCheckout(ctx context.Context, s logical.Storage, set string, c *hcpLibraryCheckout) error {
+	entry, err := logical.StorageEntryJSON(libraryCheckoutStorageKey(set, c.ServicePrincipal), c)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func deleteLibraryCheckout(ctx context.Context, s logical.Storage, set string, sp string) error {
+	return s.Delete(ctx, libraryCheckoutStorageKey(set, sp))
+}
+
+func libraryCheckoutStorageKey(set string, sp string) string {
+	return libraryCheckoutStoragePrefix + set + "/" + encodeResourceName(sp)
+}
+
+const pathLibraryHelpSyn = `
+Manage a set of existing HashiCorp Cloud Platform (HCP) service principals that can be checked out.
+`
+
+const pathLibraryHelpDesc = `
+A library set is a list of existing service principals, given by resource name,
+that Vault hands out exclusively. Checking one out creates a new service principal
+key for the caller, and checking it in, or the lease expiring, deletes that key
+and returns the service principal to the set.
+
+Vault does not change the IAM bindings of library service principals, they keep
+the roles they were given in HCP. Those roles are checked against the guardrails
+on 'config' at check-out. Each service principal can only have two keys,
+so it should have at most one other key outside of Vault.
+`
+
+const pathLibraryListHelpSyn = `
+List the library sets on the HashiCorp Cloud Platform (HCP) backend
+`
+
+const pathLibraryListHelpDesc = `
+Library sets will be listed by name
+`
+
+const pathLibraryCredentialsListHelpSyn = `
+List the active check-outs of a library set
+`
+
+const pathLibraryCredentialsListHelpDesc = `
+Check-outs will be listed by the client ID of their service principal key, along
+with the service principal, check-out time and lease expiry. Entries are added
+on check-out and removed on check-in or when the lease is revoked.
+`
@@ -0,0 +1,538 @@
+package hcpsecrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/models"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const secretTypeLibraryKey = "hcp-library-key"
+
+func (b *hcpBackend) libraryLock(set string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.libraryLocks, set)
+}
+
+func (b *hcpBackend) pathLibraryCheckout() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "library/" + framework.GenericNameRegex("name") + "/check-out",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefix,
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the set",
+					Required:    true,
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Requested lease for the check-out, capped by the set's max_ttl.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathLibraryCheckOut,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationVerb:   "check-out",
+						OperationSuffix: "library-service-principal",
+					},
+				},
+			},
+			HelpSynopsis:    pathLibraryCheckOutHelpSyn,
+			HelpDescription: pathLibraryCheckOutHelpDesc,
+		},
+		{
+			Pattern: "library/" + framework.GenericNameRegex("name") + "/check-in",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefix,
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the set",
+					Required:    true,
+				},
+				"service_principals": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Resource names of the service principals to check in. If not set, every service principal the caller has checked out from the set is checked in.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathLibraryCheckIn,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationVerb:   "check-in",
+						OperationSuffix: "library-service-principals",
+					},
+				},
+			},
+			HelpSynopsis:    pathLibraryCheckInHelpSyn,
+			HelpDescription: pathLibraryCheckInHelpDesc,
+		},
+		{
+			Pattern: "library/" + framework.GenericNameRegex("name") + "/status",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefix,
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the set",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathLibraryStatus,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "library-status",
+					},
+				},
+			},
+			HelpSynopsis:    pathLibraryStatusHelpSyn,
+			HelpDescription: pathLibraryStatusHelpDesc,
+		},
+	}
+}
+
+func (b *hcpBackend) hcpLibraryKey() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeLibraryKey,
+		Fields: map[string]*framework.FieldSchema{
+			"client_id": {
+				Type:        framework.TypeString,
+				Description: "Service principal client ID used to authenticate to HCP",
+			},
+			"client_secret": {
+				Type:        framework.TypeString,
+				Description: "Service principal client secret used to authenticate to HCP",
+			},
+			"service_principal": {
+				Type:        framework.TypeString,
+				Description: "Resource name of the checked out service principal",
+			},
+		},
+		Revoke: b.revokeLibraryKey,
+		Renew:  b.renewLibraryKey,
+	}
+}
+
+func (b *hcpBackend) pathLibraryCheckOut(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	lock := b.libraryLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	set, err := getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if set == nil {
+		return logical.ErrorResponse("library set %q does not exist", name), nil
+	}
+
+	requested := time.Duration(data.Get("ttl").(int)) * time.Second
+	ttl, warnings, err := framework.CalculateTTL(b.System(), requested, set.TTL, 0, set.MaxTTL, 0, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	checkouts, err := listLibraryCheckouts(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var available string
+	for _, sp := range set.ServicePrincipals {
+		taken := false
+		for _, c := range checkouts {
+			if c.ServicePrincipal == sp {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			available = sp
+			break
+		}
+	}
+
+	if available == "" {
+		return logical.ErrorResponse("no service principals available for check-out in set %q", name), nil
+	}
+
+	requester := newRequester(req)
+	logger := b.Logger().With("library_set", name, "service_principal", available).With(requester.logArgs()...)
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		logger.Error("failed to create HCP client", "error", err)
+		return nil, err
+	}
+
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	sp, err := getServicePrincipal(cl, available)
+	if err != nil {
+		logger.Error("failed to read service principal", "error", err)
+		return nil, err
+	}
+
+	// library service principals keep their own bindings, which must be
+	// within the guardrails like those of a role
+	role, err := libraryRole(cl, name, sp)
+	if err != nil {
+		logger.Error("failed to read service principal roles", "error", err)
+		return nil, err
+	}
+	if err := cfg.checkCheckOut(role, sp.ProjectID); err != nil {
+		logger.Warn("check-out refused by guardrails", "error", err)
+		return nil, err
+	}
+
+	logger.Debug("creating service principal key for check-out")
+	spk, err := createServicePrincipalKey(cl, sp)
+	if err != nil {
+		logger.Error("failed to create service principal key", "error", err)
+		return nil, err
+	}
+
+	checkedOutAt := time.Now().UTC()
+	checkout := &hcpLibraryCheckout{
+		ServicePrincipal: available,
+		ClientID:         spk.Key.ClientID,
+		KeyResourceName:  spk.Key.ResourceName,
+		EntityID:         req.EntityID,
+		CheckedOutAt:     checkedOutAt,
+		TokenAccessor:    req.ClientTokenAccessor,
+	}
+	if err := saveLibraryCheckout(ctx, req.Storage, name, checkout); err != nil {
+		logger.Error("failed to save check-out", "client_id", spk.Key.ClientID, "error", err)
+		// the service principal stays available, so its new key must not outlive the failed check-out
+		if delErr := deleteServicePrincipalKey(cl, spk.Key); delErr != nil {
+			logger.Error("failed to delete key of failed check-out", "client_id", spk.Key.ClientID, "error", delErr)
+		}
+		return nil, err
+	}
+
+	cred := &hcpCredential{
+		ClientID:             spk.Key.ClientID,
+		KeyResourceName:      spk.Key.ResourceName,
+		ServicePrincipal:     available,
+		ServicePrincipalName: sp.Name,
+		ServicePrincipalID:   sp.ID,
+		Requester:            requester,
+		IssuedAt:             checkedOutAt,
+		ExpiresAt:            checkedOutAt.Add(ttl),
+		LibrarySet:           name,
+		LeasePath:            req.MountPoint + req.Path,
+	}
+	if sp.ProjectID != cfg.ProjectID {
+		cred.ProjectID = sp.ProjectID
+	}
+	if err := saveCredential(ctx, req.Storage, cred); err != nil {
+		logger.Error("failed to save credential record", "client_id", cred.ClientID, "error", err)
+		if delErr := deleteServicePrincipalKey(cl, spk.Key); delErr != nil {
+			logger.Error("failed to delete key of failed check-out", "client_id", spk.Key.ClientID, "error", delErr)
+			return nil, err
+		}
+		if delErr := deleteLibraryCheckout(ctx, req.Storage, name, available); delErr != nil {
+			logger.Error("failed to delete check-out", "error", delErr)
+		}
+		return nil, err
+	}
+
+	logger.Info("checked out service principal", "client_id", spk.Key.ClientID)
+
+	internalData := map[string]interface{}{
+		"library_set":       name,
+		"service_principal": available,
+		"client_id":         spk.Key.ClientID,
+		"resource_name":     spk.Key.ResourceName,
+	}
+	for k, v := range requester.internalData() {
+		internalData[k] = v
+	}
+
+	resp := b.Secret(secretTypeLibraryKey).Response(
+		// data
+		map[string]interface{}{
+			"client_id":         spk.Key.ClientID,
+			"client_secret":     spk.ClientSecret,
+			"service_principal": available,
+		},
+		// internal data
+		internalData,
+	)
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = set.MaxTTL
+	resp.Secret.Renewable = true
+
+	for _, w := range warnings {
+		resp.AddWarning(w)
+	}
+
+	return resp, nil
+}
+
+func (b *hcpBackend) pathLibraryCheckIn(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	lock := b.libraryLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	set, err := getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if set == nil {
+		return logical.ErrorResponse("library set %q does not exist", name), nil
+	}
+
+	checkouts, err := listLibraryCheckouts(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	requested := data.Get("service_principals").([]string)
+
+	var toCheckIn []*hcpLibraryCheckout
+	for _, c := range checkouts {
+		switch {
+		case len(requested) > 0 && !strutil.StrListContains(requested, c.ServicePrincipal):
+			continue
+		case !set.DisableCheckInEnforcement && !c.heldBy(req):
+			if len(requested) > 0 {
+				return logical.ErrorResponse("service principal %q is not checked out by the caller", c.ServicePrincipal), nil
+			}
+			continue
+		}
+		toCheckIn = append(toCheckIn, c)
+	}
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	checkedIn := []string{}
+	for _, c := range toCheckIn {
+		if err := b.checkInLibraryServicePrincipal(ctx, req, cl, name, c); err != nil {
+			return nil, err
+		}
+		checkedIn = append(checkedIn, c.ServicePrincipal)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"check_ins": checkedIn,
+		},
+	}, nil
+}
+
+func (b *hcpBackend) pathLibraryStatus(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	set, err := getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if set == nil {
+		return nil, nil
+	}
+
+	checkouts, err := listLibraryCheckouts(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make(map[string]interface{}, len(set.ServicePrincipals))
+	for _, sp := range set.ServicePrincipals {
+		status[sp] = map[string]interface{}{
+			"available": true,
+		}
+	}
+	for _, c := range checkouts {
+		status[c.ServicePrincipal] = map[string]interface{}{
+			"available":      false,
+			"client_id":      c.ClientID,
+			"entity_id":      c.EntityID,
+			"checked_out_at": c.CheckedOutAt,
+		}
+	}
+
+	return &logical.Response{
+		Data: status,
+	}, nil
+}
+
+// checkInLibraryServicePrincipal deletes the key of a check-out and returns its
+// service principal to the set, the caller must hold the set lock
+func (b *hcpBackend) checkInLibraryServicePrincipal(ctx context.Context, req *logical.Request, cl *hcpClient, set string, c *hcpLibraryCheckout) error {
+	logger := b.Logger().With("library_set", set, "service_principal", c.ServicePrincipal, "client_id", c.ClientID)
+
+	logger.Debug("deleting checked out service principal key")
+	spk := &models.HashicorpCloudIamServicePrincipalKey{ResourceName: c.KeyResourceName}
+	if err := deleteServicePrincipalKey(cl, spk); err != nil && !isNotFound(err) {
+		logger.Error("failed to delete checked out service principal key", "error", err)
+		return err
+	}
+
+	if err := deleteLibraryCheckout(ctx, req.Storage, set, c.ServicePrincipal); err != nil {
+		return err
+	}
+
+	cred := &hcpCredential{ClientID: c.ClientID, ServicePrincipal: c.ServicePrincipal, LibrarySet: set}
+	if err := deleteCredential(ctx, req.Storage, cred); err != nil {
+		logger.Error("failed to delete credential record", "error", err)
+		return err
+	}
+
+	logger.Info("checked in service principal")
+	return nil
+}
+
+func (b *hcpBackend) renewLibraryKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name, ok := req.Secret.InternalData["library_set"].(string)
+	if !ok {
+		return nil, errors.New("internal data 'library_set' not found")
+	}
+
+	set, err := getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if set == nil {
+		return logical.ErrorResponse("library set %q no longer exists, the lease cannot be renewed", name), nil
+	}
+
+	// a check-in before the lease expired ends the check-out
+	if checkedOut, err := b.libraryKeyCheckedOut(ctx, req); err != nil {
+		return nil, err
+	} else if !checkedOut {
+		return logical.ErrorResponse("service principal has already been checked in"), nil
+	}
+
+	ttl, warnings, err := framework.CalculateTTL(b.System(), req.Secret.Increment, set.TTL, 0, set.MaxTTL, 0, req.Secret.IssueTime)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if err := b.updateCredentialLease(ctx, req, time.Now().UTC().Add(ttl)); err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{Secret: req.Secret}
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = set.MaxTTL
+
+	for _, w := range warnings {
+		resp.AddWarning(w)
+	}
+
+	return resp, nil
+}
+
+func (b *hcpBackend) revokeLibraryKey(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name, ok := req.Secret.InternalData["library_set"].(string)
+	if !ok {
+		return nil, errors.New("internal data 'library_set' not found")
+	}
+
+	lock := b.libraryLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	checkedOut, err := b.libraryKeyCheckedOut(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// already checked in, the key is gone and the service principal may
+	// have been checked out again by someone else
+	if !checkedOut {
+		return nil, nil
+	}
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := getLibraryCheckout(ctx, req.Storage, name, req.Secret.InternalData["service_principal"].(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.checkInLibraryServicePrincipal(ctx, req, cl, name, c); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// libraryKeyCheckedOut reports whether the check-out behind a lease is still current
+func (b *hcpBackend) libraryKeyCheckedOut(ctx context.Context, req *logical.Request) (bool, error) {
+	name, _ := req.Secret.InternalData["library_set"].(string)
+	sp, _ := req.Secret.InternalData["service_principal"].(string)
+	clientID, _ := req.Secret.InternalData["client_id"].(string)
+
+	if sp == "" || clientID == "" {
+		return false, fmt.Errorf("internal data of library lease is incomplete")
+	}
+
+	c, err := getLibraryCheckout(ctx, req.Storage, name, sp)
+	if err != nil {
+		return false, err
+	}
+
+	return c != nil && c.ClientID == clientID, nil
+}
+
+const pathLibraryCheckOutHelpSyn = `
+Check out a service principal from a library set.
+`
+
+const pathLibraryCheckOutHelpDesc = `
+This path hands out an available service principal of the set exclusively to the
+caller, with a new service principal key. The service principal stays checked
+out until it is checked in or the lease expires, at which point the key is
+deleted and the service principal is returned to the set.
+`
+
+const pathLibraryCheckInHelpSyn = `
+Check in service principals to a library set.
+`
+
+const pathLibraryCheckInHelpDesc = `
+This path deletes the key of checked out service principals and returns them to
+the set. Unless the set disables check-in enforcement, only the entity that
+checked out a service principal can check it in. Check-outs made without an
+entity, such as with a root token, can only be checked in with the same token.
+`
+
+const pathLibraryStatusHelpSyn = `
+Show which service principals of a library set are available.
+`
+
+const pathLibraryStatusHelpDesc = `
+This path lists every service principal of the set, whether it is available, and
+for checked out service principals the client ID, entity ID and check-out time.
+`
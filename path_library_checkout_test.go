@@ -0,0 +1,67 @@
+package hcpsecrets
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestLibraryCheckoutHeldBy(t *testing.T) {
+	tests := []struct {
+		name     string
+		checkout hcpLibraryCheckout
+		req      logical.Request
+		want     bool
+	}{
+		{
+			name:     "same entity",
+			checkout: hcpLibraryCheckout{EntityID: "entity-a", TokenAccessor: "accessor-a"},
+			req:      logical.Request{EntityID: "entity-a", ClientTokenAccessor: "accessor-b"},
+			want:     true,
+		},
+		{
+			name:     "other entity",
+			checkout: hcpLibraryCheckout{EntityID: "entity-a", TokenAccessor: "accessor-a"},
+			req:      logical.Request{EntityID: "entity-b", ClientTokenAccessor: "accessor-a"},
+			want:     false,
+		},
+		{
+			name:     "entity check-out and caller without entity",
+			checkout: hcpLibraryCheckout{EntityID: "entity-a"},
+			req:      logical.Request{ClientTokenAccessor: "accessor-a"},
+			want:     false,
+		},
+		{
+			name:     "no entity, same token",
+			checkout: hcpLibraryCheckout{TokenAccessor: "accessor-a"},
+			req:      logical.Request{ClientTokenAccessor: "accessor-a"},
+			want:     true,
+		},
+		{
+			name:     "no entity, other token",
+			checkout: hcpLibraryCheckout{TokenAccessor: "accessor-a"},
+			req:      logical.Request{ClientTokenAccessor: "accessor-b"},
+			want:     false,
+		},
+		{
+			name:     "no entity, caller with entity",
+			checkout: hcpLibraryCheckout{TokenAccessor: "accessor-a"},
+			req:      logical.Request{EntityID: "entity-a", ClientTokenAccessor: "accessor-b"},
+			want:     false,
+		},
+		{
+			name:     "no entity or token recorded",
+			checkout: hcpLibraryCheckout{},
+			req:      logical.Request{},
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.checkout.heldBy(&tt.req); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package hcpsecrets
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func (b *hcpBackend) pathLookup() *framework.Path {
+	return &framework.Path{
+		Pattern: "lookup",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefix,
+			OperationVerb:   "lookup",
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"client_id": {
+				Type:        framework.TypeString,
+				Description: "Client ID of an issued service principal key",
+				Query:       true,
+			},
+			"service_principal": {
+				Type:        framework.TypeString,
+				Description: "Resource name of an issued service principal. Shared service principals are not indexed, look their credentials up by client_id.",
+				Query:       true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathLookupRead,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationSuffix: "credentials",
+				},
+			},
+		},
+		HelpSynopsis:    pathLookupHelpSyn,
+		HelpDescription: pathLookupHelpDesc,
+	}
+}
+
+func (b *hcpBackend) pathLookupRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	clientID := data.Get("client_id").(string)
+	resourceName := data.Get("service_principal").(string)
+
+	var cred *hcpCredential
+	var err error
+	switch {
+	case clientID != "" && resourceName != "":
+		return logical.ErrorResponse("only one of client_id or service_principal may be set"), nil
+	case clientID != "":
+		cred, err = getCredential(ctx, req.Storage, clientID)
+	case resourceName != "":
+		cred, err = getCredentialByPrincipal(ctx, req.Storage, resourceName)
+	default:
+		return logical.ErrorResponse("one of client_id or service_principal is required"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cred == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: credentialResponseData(cred),
+	}, nil
+}
+
+func credentialResponseData(cred *hcpCredential) map[string]interface{} {
+	data := map[string]interface{}{
+		"client_id":              cred.ClientID,
+		"service_principal":      cred.ServicePrincipal,
+		"service_principal_name": cred.ServicePrincipalName,
+		"service_principal_id":   cred.ServicePrincipalID,
+		"vault_role":             cred.VaultRole,
+		"issued_at":              cred.IssuedAt,
+		"expires_at":             cred.ExpiresAt,
+		"requester":              cred.Requester.internalData(),
+		"lease_path":             cred.LeasePath,
+	}
+
+	if cred.LeaseID != "" {
+		data["lease_id"] = cred.LeaseID
+	}
+
+	if !cred.RevokedAt.IsZero() {
+		data["revoked_at"] = cred.RevokedAt
+	}
+
+	if cred.WorkloadIdentityProvider != "" {
+		data["workload_identity_provider"] = cred.WorkloadIdentityProvider
+		data["workload_identity_provider_id"] = cred.WorkloadIdentityProviderID
+	}
+
+	if cred.ProjectID != "" {
+		data["project_id"] = cred.ProjectID
+		data["ephemeral_project"] = cred.EphemeralProject
+	}
+
+	return data
+}
+
+const pathLookupHelpSyn = `
+Look up the Vault lease and requester behind a HashiCorp Cloud Platform (HCP) credential.
+`
+
+const pathLookupHelpDesc = `
+This path takes either the client ID of an issued service principal key or the
+resource name of an issued service principal, as found in HCP audit logs. It
+returns the Vault role, the issue time, the lease path, and the requesting
+entity ID, display name, mount accessor and request ID.
+
+The service principals of roles in 'shared_principal' mode carry several
+credentials at once, so they are not indexed and looking one up returns
+nothing. Look up its keys by client ID instead, or list them with
+'roles/<name>/credentials'.
+
+The lease path and client ID identify the lease. 'lease_id' is best-effort:
+Vault generates it after the credential is issued and only passes it to the
+plugin on renew, so it is returned once the lease has been renewed. Use
+'sys/leases/lookup' under the lease path to find it otherwise. Records are
+removed when the lease is revoked. Credentials revoked in HCP by
+'roles/<name>/revoke-all' are kept with 'revoked_at' until then.
+`
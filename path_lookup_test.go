@@ -0,0 +1,113 @@
+package hcpsecrets
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestLookup(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+
+	creds := []*hcpCredential{
+		{
+			ClientID:         "dynamic-client",
+			ServicePrincipal: "iam/project/p/service-principal/ci-1",
+			VaultRole:        "ci",
+			LeasePath:        "hcp/creds/ci",
+		},
+		{
+			ClientID:         "shared-client",
+			ServicePrincipal: "iam/project/p/service-principal/ci-shared-0",
+			VaultRole:        "shared",
+			LeasePath:        "hcp/creds/shared",
+			Shared:           true,
+		},
+	}
+	for _, cred := range creds {
+		if err := saveCredential(ctx, s, cred); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		data      map[string]interface{}
+		wantRole  string
+		wantError bool
+	}{
+		{
+			name:     "by client ID",
+			data:     map[string]interface{}{"client_id": "dynamic-client"},
+			wantRole: "ci",
+		},
+		{
+			name:     "by service principal",
+			data:     map[string]interface{}{"service_principal": "iam/project/p/service-principal/ci-1"},
+			wantRole: "ci",
+		},
+		{
+			name:     "shared credential by client ID",
+			data:     map[string]interface{}{"client_id": "shared-client"},
+			wantRole: "shared",
+		},
+		{
+			name: "shared service principal is not indexed",
+			data: map[string]interface{}{"service_principal": "iam/project/p/service-principal/ci-shared-0"},
+		},
+		{
+			name: "unknown client ID",
+			data: map[string]interface{}{"client_id": "unknown"},
+		},
+		{
+			name:      "neither",
+			data:      map[string]interface{}{},
+			wantError: true,
+		},
+		{
+			name:      "both",
+			data:      map[string]interface{}{"client_id": "dynamic-client", "service_principal": "iam/project/p/service-principal/ci-1"},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "lookup",
+				Storage:   s,
+				Data:      tt.data,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantError {
+				if resp == nil || !resp.IsError() {
+					t.Fatalf("got %v, want an error response", resp)
+				}
+				return
+			}
+
+			if tt.wantRole == "" {
+				if resp != nil {
+					t.Fatalf("got %v, want no response", resp.Data)
+				}
+				return
+			}
+
+			if resp == nil || resp.IsError() {
+				t.Fatalf("got %v, want a credential", resp)
+			}
+			if got := resp.Data["vault_role"]; got != tt.wantRole {
+				t.Errorf("got vault_role %v, want %q", got, tt.wantRole)
+			}
+			if _, ok := resp.Data["lease_id"]; ok {
+				t.Error("lease_id returned before the lease was renewed")
+			}
+		})
+	}
+}
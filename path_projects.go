@@ -0,0 +1,332 @@
+package hcpsecrets
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	resourcemodels "github.com/hashicorp/hcp-sdk-go/clients/cloud-resource-manager/stable/2019-12-10/models"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/identitytpl"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// basic HCP roles from least to most privileged
+var basicRoleRank = map[string]int{
+	"roles/viewer":      1,
+	"roles/contributor": 2,
+	"roles/admin":       3,
+}
+
+func (b *hcpBackend) pathProjects() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "projects/?",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefix,
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathProjectsList,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "projects",
+					},
+				},
+			},
+			HelpSynopsis:    pathProjectsListHelpSyn,
+			HelpDescription: pathProjectsListHelpDesc,
+		},
+		{
+			Pattern: "projects/" + framework.GenericNameRegex("id"),
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefix,
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"id": {
+					Type:        framework.TypeString,
+					Description: "ID of the HCP project",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathProjectRead,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "project",
+					},
+				},
+			},
+			HelpSynopsis:    pathProjectsHelpSyn,
+			HelpDescription: pathProjectsHelpDesc,
+		},
+	}
+}
+
+// projectAccess resolves the roles the plugin's service principal holds in
+// projects, including those inherited from the organization
+type projectAccess struct {
+	cl          *hcpClient
+	principalID string
+	orgRoles    []string
+}
+
+func newProjectAccess(cl *hcpClient, organizationID string) (*projectAccess, error) {
+	principalID, err := getCallerPrincipalID(cl)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &projectAccess{cl: cl, principalID: principalID}
+
+	// project level service principals cannot read the organization policy
+	if policy, err := getOrganizationIAMPolicy(cl, organizationID); err == nil {
+		a.orgRoles = policyRoles(policy, principalID)
+	}
+
+	return a, nil
+}
+
+// roles returns every role ID of the principal in the project and the most
+// privileged basic role among them
+func (a *projectAccess) roles(projectID string) ([]string, string) {
+	roles := append([]string{}, a.orgRoles...)
+
+	if policy, err := getProjectIAMPolicy(a.cl, projectID); err == nil {
+		roles = append(roles, policyRoles(policy, a.principalID)...)
+	}
+
+	effective := effectiveBasicRole(roles)
+
+	return strutil.RemoveDuplicates(roles, false), effective
+}
+
+// effectiveBasicRole returns the most privileged basic role, without its
+// "roles/" prefix, among the given role IDs
+func effectiveBasicRole(roles []string) string {
+	effective := ""
+	for _, r := range roles {
+		if basicRoleRank[r] > basicRoleRank["roles/"+effective] {
+			effective = strings.TrimPrefix(r, "roles/")
+		}
+	}
+	return effective
+}
+
+func (b *hcpBackend) projectResponseData(a *projectAccess, cfg *hcpConfig, p *resourcemodels.HashicorpCloudResourcemanagerProject) map[string]interface{} {
+	roles, effective := a.roles(p.ID)
+
+	data := map[string]interface{}{
+		"id":          p.ID,
+		"name":        p.Name,
+		"description": p.Description,
+		"created_at":  p.CreatedAt.String(),
+		"role":        effective,
+		"roles":       roles,
+		"configured":  p.ID == cfg.ProjectID,
+	}
+
+	if p.State != nil {
+		data["state"] = string(*p.State)
+	}
+
+	return data
+}
+
+func (b *hcpBackend) pathProjectsList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	projects, err := listProjects(cl, cfg.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+
+	access, err := newProjectAccess(cl, cfg.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(projects))
+	info := make(map[string]interface{}, len(projects))
+	for _, p := range projects {
+		keys = append(keys, p.ID)
+		info[p.ID] = b.projectResponseData(access, cfg, p)
+	}
+
+	return logical.ListResponseWithInfo(keys, info), nil
+}
+
+func (b *hcpBackend) pathProjectRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := getProject(cl, data.Get("id").(string))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	access, err := newProjectAccess(cl, cfg.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: b.projectResponseData(access, cfg, p),
+	}, nil
+}
+
+// credentialProject returns the ID of the project a credential of the role is
+// issued in. The project set on the role, or else the one the caller asked
+// for, by ID or name, must be in the configured organization and allowed by
+// the role. Without either, the configured project is used.
+func (b *hcpBackend) credentialProject(req *logical.Request, cl *hcpClient, cfg *hcpConfig, role *hcpRole, ref string) (string, error) {
+	if role.Project != "" {
+		if ref != "" {
+			return "", logical.CodedError(http.StatusBadRequest, fmt.Sprintf("role %q sets its project, it cannot be chosen", role.Name))
+		}
+
+		var err error
+		ref, err = b.resolveRoleProject(req, role)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(role.AllowedProjects) == 0 {
+		if ref != "" && ref != cfg.ProjectID {
+			return "", logical.CodedError(http.StatusBadRequest, fmt.Sprintf("role %q does not allow choosing a project", role.Name))
+		}
+		return cfg.ProjectID, nil
+	}
+
+	requested := ref != ""
+	if !requested {
+		ref = cfg.ProjectID
+	}
+
+	p, err := findProject(cl, cfg.OrganizationID, ref)
+	if err != nil {
+		return "", err
+	}
+
+	if !role.projectAllowed(p) {
+		if !requested {
+			return "", logical.CodedError(http.StatusBadRequest, fmt.Sprintf("role %q requires a project, the configured project is not allowed", role.Name))
+		}
+		return "", logical.CodedError(http.StatusForbidden, fmt.Sprintf("project %q is not allowed by role %q", ref, role.Name))
+	}
+
+	return p.ID, nil
+}
+
+// resolveRoleProject fills in the identity templates of the role's project for
+// the requesting entity
+func (b *hcpBackend) resolveRoleProject(req *logical.Request, role *hcpRole) (string, error) {
+	input := identitytpl.PopulateStringInput{
+		String: role.Project,
+		Mode:   identitytpl.ACLTemplating,
+	}
+
+	if req.EntityID != "" {
+		entity, err := b.System().EntityInfo(req.EntityID)
+		if err != nil {
+			return "", err
+		}
+		groups, err := b.System().GroupsForEntity(req.EntityID)
+		if err != nil {
+			return "", err
+		}
+		input.Entity = entity
+		input.Groups = groups
+	}
+
+	_, project, err := identitytpl.PopulateString(input)
+	if err == nil && project == "" {
+		err = identitytpl.ErrTemplateValueNotFound
+	}
+	if err != nil {
+		return "", logical.CodedError(http.StatusForbidden, fmt.Sprintf("project of role %q cannot be resolved for the requesting entity: %s", role.Name, err))
+	}
+
+	return project, nil
+}
+
+// findProject looks up a project of the organization by ID, falling back to
+// its name when no project has that ID
+func findProject(cl *hcpClient, organizationID string, ref string) (*resourcemodels.HashicorpCloudResourcemanagerProject, error) {
+	if p, err := getProject(cl, ref); err == nil && p.Parent != nil && p.Parent.ID == organizationID {
+		return p, nil
+	}
+
+	projects, err := listProjects(cl, organizationID)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*resourcemodels.HashicorpCloudResourcemanagerProject
+	for _, p := range projects {
+		if p.Name == ref {
+			found = append(found, p)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("project %q was not found in the configured organization", ref))
+	case 1:
+		return found[0], nil
+	default:
+		return nil, logical.CodedError(http.StatusBadRequest, fmt.Sprintf("several projects are named %q, use the project ID instead", ref))
+	}
+}
+
+// projectAllowed reports whether the project's ID or name matches one of the
+// role's allowed projects
+func (r *hcpRole) projectAllowed(p *resourcemodels.HashicorpCloudResourcemanagerProject) bool {
+	for _, pattern := range r.AllowedProjects {
+		if strutil.GlobbedStringsMatch(pattern, p.ID) || strutil.GlobbedStringsMatch(pattern, p.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+const pathProjectsListHelpSyn = `
+List the HashiCorp Cloud Platform (HCP) projects visible to the plugin.
+`
+
+const pathProjectsListHelpDesc = `
+Projects of the configured organization will be listed by ID, along with their
+name, description, state, and the roles the plugin's service principal holds in
+them, including roles inherited from the organization.
+`
+
+const pathProjectsHelpSyn = `
+Read a HashiCorp Cloud Platform (HCP) project visible to the plugin.
+`
+
+const pathProjectsHelpDesc = `
+Returns the name, description and state of the project, whether it is the
+configured project, and the roles the plugin's service principal holds in it.
+'role' is the most privileged of the basic 'admin', 'contributor' and 'viewer'
+roles, and 'roles' lists every role ID.
+`
@@ -0,0 +1,220 @@
+package hcpsecrets
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/go-openapi/runtime"
+	project "github.com/hashicorp/hcp-sdk-go/clients/cloud-resource-manager/stable/2019-12-10/client/project_service"
+	resourcemodels "github.com/hashicorp/hcp-sdk-go/clients/cloud-resource-manager/stable/2019-12-10/models"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// fakeProjectService serves projects of a fixed list, all in organization "org"
+// unless their parent says otherwise, and one IAM policy shared by all of them
+type fakeProjectService struct {
+	project.ClientService
+	projects []*resourcemodels.HashicorpCloudResourcemanagerProject
+	policy   *resourcemodels.HashicorpCloudResourcemanagerPolicy
+}
+
+func (f *fakeProjectService) ProjectServiceGetIamPolicy(params *project.ProjectServiceGetIamPolicyParams, _ runtime.ClientAuthInfoWriter, _ ...project.ClientOption) (*project.ProjectServiceGetIamPolicyOK, error) {
+	policy := f.policy
+	if policy == nil {
+		policy = &resourcemodels.HashicorpCloudResourcemanagerPolicy{}
+	}
+	return &project.ProjectServiceGetIamPolicyOK{
+		Payload: &resourcemodels.HashicorpCloudResourcemanagerProjectGetIamPolicyResponse{Policy: policy},
+	}, nil
+}
+
+func (f *fakeProjectService) ProjectServiceSetIamPolicy(params *project.ProjectServiceSetIamPolicyParams, _ runtime.ClientAuthInfoWriter, _ ...project.ClientOption) (*project.ProjectServiceSetIamPolicyOK, error) {
+	f.policy = params.Body.Policy
+	return &project.ProjectServiceSetIamPolicyOK{
+		Payload: &resourcemodels.HashicorpCloudResourcemanagerProjectSetIamPolicyResponse{Policy: f.policy},
+	}, nil
+}
+
+func (f *fakeProjectService) ProjectServiceGet(params *project.ProjectServiceGetParams, _ runtime.ClientAuthInfoWriter, _ ...project.ClientOption) (*project.ProjectServiceGetOK, error) {
+	for _, p := range f.projects {
+		if p.ID == params.ID {
+			return &project.ProjectServiceGetOK{
+				Payload: &resourcemodels.HashicorpCloudResourcemanagerProjectGetResponse{Project: p},
+			}, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (f *fakeProjectService) ProjectServiceList(params *project.ProjectServiceListParams, _ runtime.ClientAuthInfoWriter, _ ...project.ClientOption) (*project.ProjectServiceListOK, error) {
+	var projects []*resourcemodels.HashicorpCloudResourcemanagerProject
+	for _, p := range f.projects {
+		if p.Parent.ID == *params.ScopeID {
+			projects = append(projects, p)
+		}
+	}
+	return &project.ProjectServiceListOK{
+		Payload: &resourcemodels.HashicorpCloudResourcemanagerProjectListResponse{Projects: projects},
+	}, nil
+}
+
+func testProject(id, name, org string) *resourcemodels.HashicorpCloudResourcemanagerProject {
+	return &resourcemodels.HashicorpCloudResourcemanagerProject{
+		ID:     id,
+		Name:   name,
+		Parent: &resourcemodels.HashicorpCloudResourcemanagerResourceID{ID: org},
+	}
+}
+
+func TestRoleProjectAllowed(t *testing.T) {
+	p := testProject("1111-2222", "prod-eu", "org")
+
+	tests := []struct {
+		name    string
+		allowed []string
+		want    bool
+	}{
+		{name: "none", allowed: nil, want: false},
+		{name: "by ID", allowed: []string{"1111-2222"}, want: true},
+		{name: "by name", allowed: []string{"prod-eu"}, want: true},
+		{name: "by glob", allowed: []string{"staging", "prod-*"}, want: true},
+		{name: "ID glob", allowed: []string{"1111-*"}, want: true},
+		{name: "no match", allowed: []string{"staging", "dev-*"}, want: false},
+		{name: "partial name", allowed: []string{"prod"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &hcpRole{AllowedProjects: tt.allowed}
+			if got := r.projectAllowed(p); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCredentialProject(t *testing.T) {
+	cl := &hcpClient{
+		Project: &fakeProjectService{
+			projects: []*resourcemodels.HashicorpCloudResourcemanagerProject{
+				testProject("configured-id", "configured", "org"),
+				testProject("prod-eu-id", "prod-eu", "org"),
+				testProject("prod-us-id", "prod-us", "org"),
+				testProject("dup-1", "dup", "org"),
+				testProject("dup-2", "dup", "org"),
+				testProject("elsewhere-id", "prod-other", "other-org"),
+			},
+		},
+	}
+	cfg := &hcpConfig{OrganizationID: "org", ProjectID: "configured-id"}
+
+	tests := []struct {
+		name     string
+		role     hcpRole
+		ref      string
+		want     string
+		wantCode int
+	}{
+		{
+			name: "configured project by default",
+			role: hcpRole{Name: "r"},
+			want: "configured-id",
+		},
+		{
+			name: "configured project requested without allowed_projects",
+			role: hcpRole{Name: "r"},
+			ref:  "configured-id",
+			want: "configured-id",
+		},
+		{
+			name:     "other project requested without allowed_projects",
+			role:     hcpRole{Name: "r"},
+			ref:      "prod-eu-id",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "allowed project by ID",
+			role: hcpRole{Name: "r", AllowedProjects: []string{"prod-*"}},
+			ref:  "prod-eu-id",
+			want: "prod-eu-id",
+		},
+		{
+			name: "allowed project by name",
+			role: hcpRole{Name: "r", AllowedProjects: []string{"prod-*"}},
+			ref:  "prod-us",
+			want: "prod-us-id",
+		},
+		{
+			name:     "project not allowed",
+			role:     hcpRole{Name: "r", AllowedProjects: []string{"prod-eu"}},
+			ref:      "prod-us",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "configured project not allowed",
+			role:     hcpRole{Name: "r", AllowedProjects: []string{"prod-*"}},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "configured project allowed",
+			role: hcpRole{Name: "r", AllowedProjects: []string{"configured", "prod-*"}},
+			want: "configured-id",
+		},
+		{
+			name:     "project of another organization",
+			role:     hcpRole{Name: "r", AllowedProjects: []string{"*"}},
+			ref:      "elsewhere-id",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "ambiguous name",
+			role:     hcpRole{Name: "r", AllowedProjects: []string{"*"}},
+			ref:      "dup",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "role project",
+			role: hcpRole{Name: "r", AllowedProjects: []string{"prod-*"}, Project: "prod-eu"},
+			want: "prod-eu-id",
+		},
+		{
+			name:     "role project cannot be overridden",
+			role:     hcpRole{Name: "r", AllowedProjects: []string{"prod-*"}, Project: "prod-eu"},
+			ref:      "prod-us",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "role project outside allowed_projects",
+			role:     hcpRole{Name: "r", AllowedProjects: []string{"prod-us"}, Project: "prod-eu"},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "role project template without an entity",
+			role:     hcpRole{Name: "r", AllowedProjects: []string{"*"}, Project: "{{identity.entity.metadata.hcp_project}}"},
+			wantCode: http.StatusForbidden,
+		},
+	}
+
+	b := &hcpBackend{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := b.credentialProject(&logical.Request{}, cl, cfg, &tt.role, tt.ref)
+
+			if tt.wantCode != 0 {
+				var coded logical.HTTPCodedError
+				if !errors.As(err, &coded) || coded.Code() != tt.wantCode {
+					t.Fatalf("got error %v, want a %d error", err, tt.wantCode)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package hcpsecrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// maximum number of service principals HCP allows in a project
+const projectServicePrincipalLimit = 5
+
+// how often a waiting credential request checks for a free service principal slot
+const quotaPollInterval = 5 * time.Second
+
+// longest a credential request waits for a free service principal slot,
+// kept below Vault's default max request duration of 90 seconds
+const maxQuotaWait = 60 * time.Second
+
+func (b *hcpBackend) pathQuota() *framework.Path {
+	return &framework.Path{
+		Pattern: "quota",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefix,
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathQuotaRead,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationSuffix: "quota",
+				},
+			},
+		},
+		HelpSynopsis:    pathQuotaHelpSyn,
+		HelpDescription: pathQuotaHelpDesc,
+	}
+}
+
+func (b *hcpBackend) pathQuotaRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	principals, err := listServicePrincipals(ctx, req, cl)
+	if err != nil {
+		return nil, err
+	}
+
+	issued, err := req.Storage.List(ctx, credentialsStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	pooled, err := countPooled(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(principals))
+	for _, sp := range principals {
+		names = append(names, sp.Name)
+	}
+
+	available := projectServicePrincipalLimit - len(principals)
+	if available < 0 {
+		available = 0
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"limit":              projectServicePrincipalLimit,
+			"used":               len(principals),
+			"available":          available,
+			"issued_by_vault":    len(issued),
+			"pooled":             pooled,
+			"service_principals": names,
+		},
+	}, nil
+}
+
+// errQuotaExceeded is returned when the project has no room for another service principal
+func errQuotaExceeded(used int) error {
+	return logical.CodedError(http.StatusTooManyRequests, fmt.Sprintf(
+		"HCP project service principal limit reached: %d of %d service principals in use. "+
+			"Wait for existing credentials to expire, revoke them, or retry with the 'wait' parameter",
+		used, projectServicePrincipalLimit))
+}
+
+// isQuotaExceeded reports whether err was returned for a full project
+func isQuotaExceeded(err error) bool {
+	var coded logical.HTTPCodedError
+	return errors.As(err, &coded) && coded.Code() == http.StatusTooManyRequests
+}
+
+// waitForServicePrincipalSlot checks that the project has room for another
+// service principal, polling until one frees up or wait elapses
+func (b *hcpBackend) waitForServicePrincipalSlot(ctx context.Context, req *logical.Request, cl *hcpClient, wait time.Duration) error {
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	return b.waitForProjectServicePrincipalSlot(ctx, cl, cfg.ProjectID, wait)
+}
+
+// waitForProjectServicePrincipalSlot is waitForServicePrincipalSlot for the given project
+func (b *hcpBackend) waitForProjectServicePrincipalSlot(ctx context.Context, cl *hcpClient, projectID string, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+
+	for {
+		principals, err := listProjectServicePrincipals(cl, projectID)
+		if err != nil {
+			return err
+		}
+
+		used := len(principals)
+		if used < projectServicePrincipalLimit {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return errQuotaExceeded(used)
+		}
+
+		b.Logger().Debug("waiting for a free service principal slot", "project_id", projectID, "used", used, "limit", projectServicePrincipalLimit, "remaining", remaining)
+
+		interval := quotaPollInterval
+		if remaining < interval {
+			interval = remaining
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// waitForRoleServicePrincipalSlot is waitForProjectServicePrincipalSlot for a
+// request holding the role lock, if lock is not nil. The lock is released
+// while polling, and the role's active credentials are checked again once it
+// is retaken, as other requests may have issued credentials in the meantime.
+func (b *hcpBackend) waitForRoleServicePrincipalSlot(ctx context.Context, req *logical.Request, cl *hcpClient, role *hcpRole, lock *locksutil.LockEntry, projectID string, wait time.Duration) error {
+	if lock == nil || wait <= 0 {
+		return b.waitForProjectServicePrincipalSlot(ctx, cl, projectID, wait)
+	}
+
+	err := b.waitForProjectServicePrincipalSlot(ctx, cl, projectID, 0)
+	if err == nil || !isQuotaExceeded(err) {
+		return err
+	}
+
+	lock.Unlock()
+	err = b.waitForProjectServicePrincipalSlot(ctx, cl, projectID, wait)
+	lock.Lock()
+	if err != nil {
+		return err
+	}
+
+	return checkActiveCredentials(ctx, req.Storage, role)
+}
+
+const pathQuotaHelpSyn = `
+Report how much of the HashiCorp Cloud Platform (HCP) service principal limit is in use.
+`
+
+const pathQuotaHelpDesc = `
+HCP projects can only have five service principals, including the one used by
+this secrets engine. This path lists the service principals in the configured
+project and reports how many slots are used and available, how many
+credentials were issued by this mount, and how many service principals are
+held in role pools.
+
+When the limit is reached, 'creds/<name>' fails with a 429 error unless the
+'wait' parameter is set, in which case it waits up to that long, at most one
+minute, for a slot.
+`
@@ -4,18 +4,89 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/identitytpl"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/helper/template"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+// modes for handling credentials already issued by a role when its HCP role changes
+const (
+	existingCredentialsNone      = "none"
+	existingCredentialsPropagate = "propagate"
+	existingCredentialsRevoke    = "revoke"
+)
+
+// types of credential a role issues
+const (
+	roleTypeServicePrincipal = "service_principal"
+	roleTypeProject          = "project"
+	roleTypeWorkloadIdentity = "workload_identity"
+	roleTypeVaultAdminToken  = "vault_admin_token"
+	roleTypeConsulToken      = "consul_token"
+)
+
+// modes for how a role issues credentials
+const (
+	roleModeDynamic         = "dynamic"
+	roleModeSharedPrincipal = "shared_principal"
+)
+
 type hcpRole struct {
 	Name   string        `json:"name"`
 	Role   string        `json:"role"`
 	TTL    time.Duration `json:"ttl,omitempty"`
 	MaxTTL time.Duration `json:"max_ttl,omitempty"`
+
+	Renewable bool `json:"renewable"`
+
+	// MaxActiveCredentials caps the credentials the role can have issued at once, 0 means no cap
+	MaxActiveCredentials int `json:"max_active_credentials,omitempty"`
+
+	// PoolSize is the number of service principals kept pre-created and bound
+	PoolSize int `json:"pool_size,omitempty"`
+
+	// Mode is either dynamic, a new service principal per credential, or
+	// shared_principal, keys issued on long-lived service principals of the role
+	Mode                 string `json:"mode"`
+	SharedPrincipalCount int    `json:"shared_principal_count,omitempty"`
+
+	// Type is either service_principal, a key for a service principal in the
+	// configured project, or project, a new project per lease
+	Type                   string `json:"type"`
+	ProjectNameTemplate    string `json:"project_name_template,omitempty"`
+	ProjectDescription     string `json:"project_description,omitempty"`
+	RequireProjectDeletion bool   `json:"require_project_deletion,omitempty"`
+
+	// OIDC federation of workload_identity roles
+	OIDCIssuer            string   `json:"oidc_issuer,omitempty"`
+	OIDCAudiences         []string `json:"oidc_audiences,omitempty"`
+	OIDCConditionalAccess string   `json:"oidc_conditional_access,omitempty"`
+
+	// ClusterID is the HCP Vault Dedicated or HCP Consul Dedicated cluster of
+	// vault_admin_token and consul_token roles
+	ClusterID        string `json:"cluster_id,omitempty"`
+	ConsulCredential string `json:"consul_credential,omitempty"`
+
+	// AllowedProjects are the IDs, names or globs of the projects callers may
+	// choose to issue service_principal credentials in
+	AllowedProjects []string `json:"allowed_projects,omitempty"`
+
+	// Project is the project credentials are issued in instead of one chosen
+	// by the caller, and may contain identity templates
+	Project string `json:"project,omitempty"`
+
+	// RequireJustification makes the role a break-glass role, whose
+	// credentials are only issued with a justification and whose leases are
+	// capped at JustificationMaxTTL when set
+	RequireJustification bool          `json:"require_justification,omitempty"`
+	JustificationMaxTTL  time.Duration `json:"justification_max_ttl,omitempty"`
 }
 
 func (b *hcpBackend) pathRoles() []*framework.Path {
@@ -33,8 +104,7 @@ func (b *hcpBackend) pathRoles() []*framework.Path {
 				},
 				"role": {
 					Type:        framework.TypeString,
-					Description: "Role of the service principal created in the HashiCorp Cloud Platform (HCP). Valid values: `Admin`, `Contributor`, `Viewer`",
-					Required:    true,
+					Description: "Role of the service principal created in the HashiCorp Cloud Platform (HCP). Valid values: `Admin`, `Contributor`, `Viewer`. Not used by `vault_admin_token` roles.",
 				},
 				"ttl": {
 					Type:        framework.TypeDurationSecond,
@@ -44,14 +114,110 @@ func (b *hcpBackend) pathRoles() []*framework.Path {
 					Type:        framework.TypeDurationSecond,
 					Description: "Maximum time for role. If not set or set to 0, will use mount/system default.",
 				},
+				"renewable": {
+					Type:        framework.TypeBool,
+					Description: "Whether leases of generated credentials can be renewed.",
+					Default:     true,
+				},
+				"max_active_credentials": {
+					Type:        framework.TypeInt,
+					Description: "Maximum number of credentials the role can have active at once. If not set or set to 0, there is no limit beyond the HCP project limit.",
+				},
+				"pool_size": {
+					Type:        framework.TypeInt,
+					Description: "Number of service principals to keep pre-created and bound to the HCP role for faster issuance. Pooled service principals count against the HCP project limit.",
+				},
+				"mode": {
+					Type:        framework.TypeString,
+					Description: "How credentials are issued. Valid values: `dynamic`, a new service principal per credential, and `shared_principal`, a new key on a long-lived service principal of the role",
+				},
+				"shared_principal_count": {
+					Type:        framework.TypeInt,
+					Description: "Number of long-lived service principals to shard keys across in `shared_principal` mode. Each service principal holds at most two keys, including any created outside Vault.",
+				},
+				"type": {
+					Type:        framework.TypeString,
+					Description: "Type of credential issued. Valid values: `service_principal`, a service principal key in the configured project, `project`, a new project per lease with its own service principal, `workload_identity`, a service principal federated with an OIDC issuer instead of a key, `vault_admin_token`, an admin token for an HCP Vault Dedicated cluster, and `consul_token`, a root ACL token or client configuration for an HCP Consul Dedicated cluster",
+				},
+				"project_name_template": {
+					Type:        framework.TypeString,
+					Description: "Template for the names of projects created by `project` roles. Supports `.RoleName` and `.DisplayName` and the Vault username template functions.",
+				},
+				"project_description": {
+					Type:        framework.TypeString,
+					Description: "Description of projects created by `project` roles",
+				},
+				"require_project_deletion": {
+					Type:        framework.TypeBool,
+					Description: "Fail lease revocation of `project` roles until the project is deleted. HCP only deletes empty projects. When false, a project that cannot be deleted is left in place and logged.",
+				},
+				"oidc_issuer": {
+					Type:        framework.TypeString,
+					Description: "Issuer URL of the OIDC tokens that `workload_identity` roles federate with, for example `https://token.actions.githubusercontent.com`",
+				},
+				"oidc_audiences": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Audiences accepted in OIDC tokens of `workload_identity` roles. If not set, HCP accepts the workload identity provider's resource name.",
+				},
+				"oidc_conditional_access": {
+					Type:        framework.TypeString,
+					Description: "Conditions on the OIDC token claims of `workload_identity` roles, for example `jwt_claims.sub == \"repo:org/repo:ref:refs/heads/main\"`",
+				},
+				"cluster_id": {
+					Type:        framework.TypeString,
+					Description: "ID of the HCP Vault Dedicated or HCP Consul Dedicated cluster in the configured project that `vault_admin_token` and `consul_token` roles issue credentials for",
+				},
+				"consul_credential": {
+					Type:        framework.TypeString,
+					Description: "What `consul_token` roles issue. Valid values: `root_token`, a new root ACL token, and `client_config`, the CA and client agent configuration. Defaults to `root_token`.",
+				},
+				"allowed_projects": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "IDs, names or glob patterns of the projects in the configured organization that callers may choose with the `project` parameter of `creds`. Only used by `service_principal` roles in `dynamic` mode without a pool.",
+				},
+				"project": {
+					Type:        framework.TypeString,
+					Description: "ID or name of the project credentials are issued in, which callers cannot override. Supports identity templates such as `{{identity.entity.metadata.hcp_project}}`, resolved for the requesting entity. The result must match allowed_projects.",
+				},
+				"require_justification": {
+					Type:        framework.TypeBool,
+					Description: "Only issue credentials when the caller provides a `justification`, and optionally a `ticket_id`, for break-glass access",
+				},
+				"justification_max_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Cap on the lease of credentials of roles with require_justification, below max_ttl. If not set or set to 0, max_ttl applies.",
+				},
+				"existing_credentials": {
+					Type:        framework.TypeString,
+					Description: "How to handle credentials already issued by the role when its HCP role changes. Valid values: `none`, `propagate`, and `revoke`, which revokes them in HCP as roles/<name>/revoke-all does. Plugins cannot revoke Vault leases, so their leases can no longer be renewed but are listed until they expire.",
+					Default:     existingCredentialsNone,
+				},
+				"force": {
+					Type:        framework.TypeBool,
+					Description: "Delete the role even if it has active credentials, revoking them in HCP first. Their leases can no longer be renewed. Only used on delete.",
+					Query:       true,
+				},
 			},
+			ExistenceCheck: b.pathRoleExistenceCheck,
 			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathRoleWrite,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "role",
+					},
+				},
 				logical.UpdateOperation: &framework.PathOperation{
 					Callback: b.pathRoleWrite,
 					DisplayAttrs: &framework.DisplayAttributes{
 						OperationSuffix: "role",
 					},
 				},
+				logical.PatchOperation: &framework.PathOperation{
+					Callback: b.pathRolePatch,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "role",
+					},
+				},
 				logical.ReadOperation: &framework.PathOperation{
 					Callback: b.pathRoleRead,
 					DisplayAttrs: &framework.DisplayAttributes{
@@ -84,24 +250,93 @@ func (b *hcpBackend) pathRoles() []*framework.Path {
 			HelpSynopsis:    pathRolesListHelpSyn,
 			HelpDescription: pathRolesListHelpDesc,
 		},
+		{
+			Pattern: "roles/" + framework.GenericNameRegex("name") + "/credentials/?",
+			DisplayAttrs: &framework.DisplayAttributes{
+				OperationPrefix: operationPrefix,
+			},
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the role",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathRoleCredentialsList,
+					DisplayAttrs: &framework.DisplayAttributes{
+						OperationSuffix: "role-credentials",
+					},
+				},
+			},
+			HelpSynopsis:    pathRoleCredentialsListHelpSyn,
+			HelpDescription: pathRoleCredentialsListHelpDesc,
+		},
+	}
+}
+
+func (b *hcpBackend) pathRoleExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
+	role, err := getRole(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return false, err
 	}
+	return role != nil, nil
 }
 
 func (b *hcpBackend) pathRoleWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	name := data.Get("name").(string)
-	role := strings.ToLower(data.Get("role").(string))
 
-	if role == "" {
-		return logical.ErrorResponse("role is empty"), nil
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	previous, err := getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// updates only change the fields that were provided
+	r := &hcpRole{Name: name, Renewable: true, Mode: roleModeDynamic, Type: roleTypeServicePrincipal}
+	if previous != nil {
+		*r = *previous
+	}
+
+	return b.writeRole(ctx, req, data, previous, r)
+}
+
+func (b *hcpBackend) pathRolePatch(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	previous, err := getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
 	}
 
-	if role != "admin" && role != "contributor" && role != "viewer" {
-		return logical.ErrorResponse("role is invalid. Valid values: `admin`, `contributor`, `viewer` "), nil
+	if previous == nil {
+		return logical.RespondWithStatusCode(logical.ErrorResponse("role %q does not exist", name), req, http.StatusNotFound)
 	}
 
-	r := &hcpRole{
-		Name: name,
-		Role: role,
+	r := new(hcpRole)
+	*r = *previous
+
+	return b.writeRole(ctx, req, data, previous, r)
+}
+
+// writeRole applies the provided fields to r, validates and saves it, and
+// handles credentials already issued by the role if its HCP role changed
+func (b *hcpBackend) writeRole(ctx context.Context, req *logical.Request, data *framework.FieldData, previous *hcpRole, r *hcpRole) (*logical.Response, error) {
+	existing := strings.ToLower(data.Get("existing_credentials").(string))
+	if existing != existingCredentialsNone && existing != existingCredentialsPropagate && existing != existingCredentialsRevoke {
+		return logical.ErrorResponse("existing_credentials is invalid. Valid values: `none`, `propagate`, `revoke`"), nil
+	}
+
+	if role, ok := data.GetOk("role"); ok {
+		r.Role = strings.ToLower(role.(string))
 	}
 
 	if ttl, ok := data.GetOk("ttl"); ok {
@@ -112,50 +347,521 @@ func (b *hcpBackend) pathRoleWrite(ctx context.Context, req *logical.Request, da
 		r.MaxTTL = time.Duration(maxTTL.(int)) * time.Second
 	}
 
+	if renewable, ok := data.GetOk("renewable"); ok {
+		r.Renewable = renewable.(bool)
+	}
+
+	if maxActive, ok := data.GetOk("max_active_credentials"); ok {
+		r.MaxActiveCredentials = maxActive.(int)
+	}
+
+	if poolSize, ok := data.GetOk("pool_size"); ok {
+		r.PoolSize = poolSize.(int)
+	}
+
+	if mode, ok := data.GetOk("mode"); ok {
+		r.Mode = strings.ToLower(mode.(string))
+	}
+
+	if count, ok := data.GetOk("shared_principal_count"); ok {
+		r.SharedPrincipalCount = count.(int)
+	}
+
+	if r.Mode == roleModeSharedPrincipal && r.SharedPrincipalCount == 0 {
+		r.SharedPrincipalCount = 1
+	}
+
+	if roleType, ok := data.GetOk("type"); ok {
+		r.Type = strings.ToLower(roleType.(string))
+	}
+
+	if tmpl, ok := data.GetOk("project_name_template"); ok {
+		r.ProjectNameTemplate = tmpl.(string)
+	}
+
+	if desc, ok := data.GetOk("project_description"); ok {
+		r.ProjectDescription = desc.(string)
+	}
+
+	if require, ok := data.GetOk("require_project_deletion"); ok {
+		r.RequireProjectDeletion = require.(bool)
+	}
+
+	if issuer, ok := data.GetOk("oidc_issuer"); ok {
+		r.OIDCIssuer = issuer.(string)
+	}
+
+	if audiences, ok := data.GetOk("oidc_audiences"); ok {
+		r.OIDCAudiences = audiences.([]string)
+	}
+
+	if conditions, ok := data.GetOk("oidc_conditional_access"); ok {
+		r.OIDCConditionalAccess = conditions.(string)
+	}
+
+	if clusterID, ok := data.GetOk("cluster_id"); ok {
+		r.ClusterID = clusterID.(string)
+	}
+
+	if consulCredential, ok := data.GetOk("consul_credential"); ok {
+		r.ConsulCredential = strings.ToLower(consulCredential.(string))
+	}
+
+	if allowedProjects, ok := data.GetOk("allowed_projects"); ok {
+		r.AllowedProjects = allowedProjects.([]string)
+	}
+
+	if project, ok := data.GetOk("project"); ok {
+		r.Project = project.(string)
+	}
+
+	if require, ok := data.GetOk("require_justification"); ok {
+		r.RequireJustification = require.(bool)
+	}
+
+	if maxTTL, ok := data.GetOk("justification_max_ttl"); ok {
+		r.JustificationMaxTTL = time.Duration(maxTTL.(int)) * time.Second
+	}
+
+	// cluster tokens have no HCP role, and admin tokens cannot be renewed
+	if !r.issuesServicePrincipal() {
+		if _, ok := data.GetOk("role"); !ok {
+			r.Role = ""
+		}
+	}
+	if r.Type == roleTypeVaultAdminToken {
+		r.Renewable = false
+	}
+	if r.Type == roleTypeConsulToken && r.ConsulCredential == "" {
+		r.ConsulCredential = consulCredentialRootToken
+	}
+
+	// service principals of a new project are its administrators by default
+	if r.Type == roleTypeProject {
+		if r.Role == "" {
+			r.Role = "admin"
+		}
+		if r.ProjectNameTemplate == "" {
+			r.ProjectNameTemplate = defaultProjectNameTemplate
+		}
+	}
+
+	warnings, err := b.validateRole(r)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	// roles can be written before the engine is configured, in which case
+	// the guardrails are only checked on issuance
+	cfg, err := readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if cfg != nil {
+		if err := cfg.checkRole(r, ""); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	if previous != nil && (previous.Mode != r.Mode || previous.Type != r.Type) {
+		active, err := listRoleCredentials(ctx, req.Storage, r.Name)
+		if err != nil {
+			return nil, err
+		}
+		if len(active) > 0 {
+			return logical.ErrorResponse("type and mode cannot be changed while the role has %d active credentials", len(active)), nil
+		}
+	}
+
+	// remove shared service principals that are no longer used
+	sharedFrom := -1
+	switch {
+	case previous != nil && previous.Mode == roleModeSharedPrincipal && r.Mode != roleModeSharedPrincipal:
+		sharedFrom = 0
+	case previous != nil && r.Mode == roleModeSharedPrincipal && r.SharedPrincipalCount < previous.SharedPrincipalCount:
+		sharedFrom = r.SharedPrincipalCount
+	}
+	if sharedFrom >= 0 {
+		if err := b.destroySharedServicePrincipals(ctx, req, r.Name, sharedFrom); err != nil {
+			return logical.ErrorResponse("cannot reduce shared service principals: %s", err), nil
+		}
+	}
+
+	if err := saveRole(ctx, req.Storage, r); err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{}
+	for _, w := range warnings {
+		resp.AddWarning(w)
+	}
+
+	// shared service principals belong to the role rather than to a single
+	// credential, so they always follow the role's HCP role
+	if r.Mode == roleModeSharedPrincipal && previous != nil && previous.Role != r.Role {
+		if err := b.rebindSharedServicePrincipals(ctx, req, r); err != nil {
+			return nil, err
+		}
+		if existing == existingCredentialsNone {
+			resp.AddWarning("shared service principals were rebound to the new role, which also applies to their active credentials")
+		}
+	}
+
+	if previous != nil && previous.Role != r.Role && existing != existingCredentialsNone {
+		result, err := b.updateExistingCredentials(ctx, req, r, existing)
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Data = map[string]interface{}{
+			"existing_credentials": result,
+		}
+
+		if revoked, ok := result["revoked"].([]map[string]interface{}); ok && len(revoked) > 0 {
+			resp.AddWarning(leaseRemainWarning(req, r.Name))
+		}
+	}
+
+	if resp.Data == nil && len(resp.Warnings) == 0 {
+		return nil, nil
+	}
+
+	return resp, nil
+}
+
+// validateRole checks a role before it is saved, returning an error for
+// invalid values and warnings for values Vault will cap
+func (b *hcpBackend) validateRole(r *hcpRole) ([]string, error) {
+	// cluster tokens are not issued to a service principal, so there is no HCP role to bind
+	if !r.issuesServicePrincipal() {
+		if r.Role != "" {
+			return nil, fmt.Errorf("role cannot be set on `%s` roles", r.Type)
+		}
+	} else {
+		if r.Role == "" {
+			return nil, errors.New("role is empty")
+		}
+
+		if r.Role != "admin" && r.Role != "contributor" && r.Role != "viewer" {
+			return nil, errors.New("role is invalid. Valid values: `admin`, `contributor`, `viewer` ")
+		}
+	}
+
 	if r.MaxTTL != 0 && r.TTL > r.MaxTTL {
-		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
+		return nil, errors.New("ttl cannot be greater than max_ttl")
+	}
+
+	if r.JustificationMaxTTL < 0 {
+		return nil, errors.New("justification_max_ttl cannot be negative")
+	}
+
+	if r.JustificationMaxTTL != 0 && !r.RequireJustification {
+		return nil, errors.New("justification_max_ttl can only be set with require_justification")
+	}
+
+	if r.MaxActiveCredentials < 0 {
+		return nil, errors.New("max_active_credentials cannot be negative")
+	}
+
+	if r.PoolSize < 0 || r.PoolSize >= projectServicePrincipalLimit {
+		return nil, fmt.Errorf("pool_size must be between 0 and %d", projectServicePrincipalLimit-1)
+	}
+
+	switch r.Mode {
+	case roleModeDynamic:
+		if r.SharedPrincipalCount != 0 {
+			return nil, errors.New("shared_principal_count can only be set in `shared_principal` mode")
+		}
+	case roleModeSharedPrincipal:
+		if r.PoolSize != 0 {
+			return nil, errors.New("pool_size cannot be used in `shared_principal` mode")
+		}
+		if r.SharedPrincipalCount < 1 || r.SharedPrincipalCount >= projectServicePrincipalLimit {
+			return nil, fmt.Errorf("shared_principal_count must be between 1 and %d", projectServicePrincipalLimit-1)
+		}
+	default:
+		return nil, errors.New("mode is invalid. Valid values: `dynamic`, `shared_principal`")
+	}
+
+	if r.Type != roleTypeProject && (r.ProjectNameTemplate != "" || r.ProjectDescription != "" || r.RequireProjectDeletion) {
+		return nil, errors.New("project_name_template, project_description and require_project_deletion can only be set on `project` roles")
+	}
+
+	if r.issuesServicePrincipal() && r.ClusterID != "" {
+		return nil, errors.New("cluster_id can only be set on `vault_admin_token` and `consul_token` roles")
+	}
+
+	if r.Type != roleTypeConsulToken && r.ConsulCredential != "" {
+		return nil, errors.New("consul_credential can only be set on `consul_token` roles")
+	}
+
+	if r.Type != roleTypeWorkloadIdentity && (r.OIDCIssuer != "" || len(r.OIDCAudiences) > 0 || r.OIDCConditionalAccess != "") {
+		return nil, errors.New("oidc_issuer, oidc_audiences and oidc_conditional_access can only be set on `workload_identity` roles")
+	}
+
+	if r.Type != roleTypeServicePrincipal && (len(r.AllowedProjects) > 0 || r.Project != "") {
+		return nil, errors.New("allowed_projects and project can only be set on `service_principal` roles")
 	}
 
-	entry, err := logical.StorageEntryJSON("roles/"+r.Name, r)
+	switch r.Type {
+	case roleTypeServicePrincipal:
+		// pooled and shared service principals live in the configured project
+		if len(r.AllowedProjects) > 0 && (r.Mode != roleModeDynamic || r.PoolSize != 0) {
+			return nil, errors.New("allowed_projects cannot be used with pool_size or `shared_principal` mode")
+		}
+		// a templated project could resolve to any project, so it is always
+		// bounded by allowed_projects
+		if r.Project != "" {
+			if len(r.AllowedProjects) == 0 {
+				return nil, errors.New("project requires allowed_projects")
+			}
+			if _, _, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+				String:            r.Project,
+				Mode:              identitytpl.ACLTemplating,
+				ValidityCheckOnly: true,
+			}); err != nil {
+				return nil, fmt.Errorf("invalid project template: %w", err)
+			}
+		}
+	case roleTypeProject:
+		if r.Mode != roleModeDynamic || r.PoolSize != 0 {
+			return nil, errors.New("`project` roles cannot use pool_size or `shared_principal` mode")
+		}
+		if _, err := template.NewTemplate(template.Template(r.ProjectNameTemplate)); err != nil {
+			return nil, fmt.Errorf("invalid project_name_template: %w", err)
+		}
+	case roleTypeWorkloadIdentity:
+		if r.Mode != roleModeDynamic || r.PoolSize != 0 {
+			return nil, errors.New("`workload_identity` roles cannot use pool_size or `shared_principal` mode")
+		}
+		if r.OIDCIssuer == "" || r.OIDCConditionalAccess == "" {
+			return nil, errors.New("`workload_identity` roles require oidc_issuer and oidc_conditional_access")
+		}
+		if u, err := url.Parse(r.OIDCIssuer); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, errors.New("oidc_issuer must be an https URL")
+		}
+	case roleTypeVaultAdminToken, roleTypeConsulToken:
+		if r.Mode != roleModeDynamic || r.PoolSize != 0 || r.MaxActiveCredentials != 0 {
+			return nil, fmt.Errorf("`%s` roles cannot use pool_size, max_active_credentials or `shared_principal` mode", r.Type)
+		}
+		if r.ClusterID == "" {
+			return nil, fmt.Errorf("`%s` roles require cluster_id", r.Type)
+		}
+		if r.Type == roleTypeVaultAdminToken && r.leaseMaxTTL() != 0 && r.leaseMaxTTL() < vaultAdminTokenTTL {
+			return nil, fmt.Errorf("`vault_admin_token` roles cannot have a max TTL below %s, the lifetime of admin tokens", vaultAdminTokenTTL)
+		}
+		if r.Type == roleTypeConsulToken && r.ConsulCredential != consulCredentialRootToken && r.ConsulCredential != consulCredentialClientConfig {
+			return nil, errors.New("consul_credential is invalid. Valid values: `root_token`, `client_config`")
+		}
+	default:
+		return nil, errors.New("type is invalid. Valid values: `service_principal`, `project`, `workload_identity`, `vault_admin_token`, `consul_token`")
+	}
+
+	var warnings []string
+	mountMaxTTL := b.System().MaxLeaseTTL()
+	if r.MaxTTL > mountMaxTTL {
+		warnings = append(warnings, fmt.Sprintf("max_ttl is greater than the mount's max TTL of %s, leases will be capped accordingly", mountMaxTTL))
+	}
+	if r.TTL > mountMaxTTL {
+		warnings = append(warnings, fmt.Sprintf("ttl is greater than the mount's max TTL of %s, leases will be capped accordingly", mountMaxTTL))
+	}
+
+	return warnings, nil
+}
+
+// updateExistingCredentials applies a changed HCP role to the credentials the
+// role has already issued, either by rebinding their service principals to the
+// new HCP role or by revoking them in HCP as roles/<name>/revoke-all does
+func (b *hcpBackend) updateExistingCredentials(ctx context.Context, req *logical.Request, role *hcpRole, mode string) (map[string]interface{}, error) {
+	logger := b.Logger().With("vault_role", role.Name, "hcp_role", role.Role, "mode", mode)
+
+	if mode == existingCredentialsRevoke {
+		revoked, failed, err := b.revokeRoleCredentials(ctx, req, role.Name, defaultRevokeConcurrency)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"mode":    mode,
+			"revoked": revoked,
+			"failed":  failed,
+		}, nil
+	}
+
+	clientIDs, err := listRoleCredentials(ctx, req.Storage, role.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := getConfig(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	// service principals are rebound in the project they were issued in
+	updated := map[string][]string{}
+	principalIDs := map[string][]string{}
+	count := 0
+	for _, clientID := range clientIDs {
+		cred, err := getCredential(ctx, req.Storage, clientID)
+		if err != nil {
+			return nil, err
+		}
+		// shared service principals are rebound with the role itself, and
+		// ephemeral projects are not shared with other credentials
+		if cred == nil || cred.ServicePrincipalID == "" || cred.Shared || cred.EphemeralProject {
+			continue
+		}
+		projectID := cfg.ProjectID
+		if cred.ProjectID != "" {
+			projectID = cred.ProjectID
+		}
+		updated[projectID] = append(updated[projectID], clientID)
+		principalIDs[projectID] = append(principalIDs[projectID], cred.ServicePrincipalID)
+		count++
+	}
+
+	result := map[string]interface{}{
+		"mode":    mode,
+		"updated": []string{},
+	}
+
+	if count == 0 {
+		return result, nil
+	}
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
 		return nil, err
 	}
 
-	return nil, nil
+	logger.Info("rebinding existing service principals to new role", "count", count)
+	done := []string{}
+	var errs []string
+	for projectID, ids := range principalIDs {
+		if err := rebindProjectServicePrincipals(cl, projectID, role.Role, ids...); err != nil {
+			logger.Error("failed to rebind existing service principals", "project_id", projectID, "error", err)
+			errs = append(errs, fmt.Sprintf("project %s: %s", projectID, err))
+			continue
+		}
+		done = append(done, updated[projectID]...)
+	}
+
+	result["updated"] = done
+	if len(errs) > 0 {
+		result["error"] = strings.Join(errs, "; ")
+	}
+
+	return result, nil
 }
 
 func (b *hcpBackend) pathRoleRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	entry, err := req.Storage.Get(ctx, "roles/"+data.Get("name").(string))
+	role, err := getRole(ctx, req.Storage, data.Get("name").(string))
 	if err != nil {
 		return nil, err
 	}
 
-	if entry == nil {
+	if role == nil {
 		return nil, errors.New("error retrieving role: role is nil")
 	}
 
-	role := new(hcpRole)
-	if err := entry.DecodeJSON(&role); err != nil {
-		return nil, fmt.Errorf("error reading role configuration")
-	}
-
-	return &logical.Response{
+	resp := &logical.Response{
 		Data: map[string]interface{}{
-			"name":    role.Name,
-			"role":    role.Role,
-			"ttl":     role.TTL.Seconds(),
-			"max_ttl": role.MaxTTL.Seconds(),
+			"name":                   role.Name,
+			"role":                   role.Role,
+			"ttl":                    role.TTL.Seconds(),
+			"max_ttl":                role.MaxTTL.Seconds(),
+			"renewable":              role.Renewable,
+			"max_active_credentials": role.MaxActiveCredentials,
+			"pool_size":              role.PoolSize,
+			"mode":                   role.Mode,
+			"shared_principal_count": role.SharedPrincipalCount,
+			"type":                   role.Type,
+			"require_justification":  role.RequireJustification,
+			"justification_max_ttl":  role.JustificationMaxTTL.Seconds(),
 		},
-	}, nil
+	}
+
+	if role.Type == roleTypeServicePrincipal {
+		resp.Data["allowed_projects"] = role.AllowedProjects
+		resp.Data["project"] = role.Project
+	}
+
+	if role.Type == roleTypeProject {
+		resp.Data["project_name_template"] = role.ProjectNameTemplate
+		resp.Data["project_description"] = role.ProjectDescription
+		resp.Data["require_project_deletion"] = role.RequireProjectDeletion
+	}
+
+	if !role.issuesServicePrincipal() {
+		resp.Data["cluster_id"] = role.ClusterID
+	}
+
+	if role.Type == roleTypeConsulToken {
+		resp.Data["consul_credential"] = role.ConsulCredential
+	}
+
+	if role.Type == roleTypeWorkloadIdentity {
+		resp.Data["oidc_issuer"] = role.OIDCIssuer
+		resp.Data["oidc_audiences"] = role.OIDCAudiences
+		resp.Data["oidc_conditional_access"] = role.OIDCConditionalAccess
+	}
+
+	return resp, nil
 }
 
 func (b *hcpBackend) pathRoleDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	err := req.Storage.Delete(ctx, "roles/"+data.Get("name").(string))
-	return nil, err
+	name := data.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	clientIDs, err := listRoleCredentials(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *logical.Response
+	if len(clientIDs) > 0 {
+		if !data.Get("force").(bool) {
+			return logical.ErrorResponse("role %q has %d active credentials, revoke them with roles/%s/revoke-all or set force=true to revoke them and delete the role", name, len(clientIDs), name), nil
+		}
+
+		revoked, failed, err := b.revokeRoleCredentials(ctx, req, name, defaultRevokeConcurrency)
+		if err != nil {
+			return nil, err
+		}
+
+		// keep the role while any of its credentials are still live in HCP
+		if len(failed) > 0 {
+			resp = logical.ErrorResponse("failed to revoke %d credentials of role %q, the role was not deleted", len(failed), name)
+			resp.Data["revoked"] = revoked
+			resp.Data["failed"] = failed
+			return resp, nil
+		}
+
+		resp = &logical.Response{
+			Data: map[string]interface{}{
+				"revoked": revoked,
+			},
+		}
+		resp.AddWarning(leaseRemainWarning(req, name))
+	}
+
+	if err := b.drainPool(ctx, req, name); err != nil {
+		return nil, err
+	}
+
+	if err := b.destroySharedServicePrincipals(ctx, req, name, 0); err != nil {
+		return nil, err
+	}
+
+	if err := req.Storage.Delete(ctx, "roles/"+name); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
 }
 
 func (b *hcpBackend) pathRolesList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -166,6 +872,84 @@ func (b *hcpBackend) pathRolesList(ctx context.Context, req *logical.Request, da
 	return logical.ListResponse(entries), nil
 }
 
+func (b *hcpBackend) pathRoleCredentialsList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	clientIDs, err := listRoleCredentials(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	return credentialListResponse(ctx, req.Storage, clientIDs)
+}
+
+// credentialListResponse lists the credential records of the given client IDs
+func credentialListResponse(ctx context.Context, s logical.Storage, clientIDs []string) (*logical.Response, error) {
+	keys := make([]string, 0, len(clientIDs))
+	keyInfo := make(map[string]interface{}, len(clientIDs))
+	for _, clientID := range clientIDs {
+		cred, err := getCredential(ctx, s, clientID)
+		if err != nil {
+			return nil, err
+		}
+
+		// skip index entries whose record has already been removed
+		if cred == nil {
+			continue
+		}
+
+		keys = append(keys, clientID)
+		keyInfo[clientID] = map[string]interface{}{
+			"service_principal_name": cred.ServicePrincipalName,
+			"service_principal":      cred.ServicePrincipal,
+			"issued_at":              cred.IssuedAt,
+			"expires_at":             cred.ExpiresAt,
+		}
+	}
+
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+// leaseMaxTTL returns the max TTL of the role's leases, which break-glass
+// roles can cap below max_ttl
+func (r *hcpRole) leaseMaxTTL() time.Duration {
+	if r.JustificationMaxTTL > 0 && (r.MaxTTL == 0 || r.JustificationMaxTTL < r.MaxTTL) {
+		return r.JustificationMaxTTL
+	}
+	return r.MaxTTL
+}
+
+// issuesServicePrincipal reports whether the role's credentials are service
+// principals bound to an HCP role, rather than cluster tokens
+func (r *hcpRole) issuesServicePrincipal() bool {
+	return r.Type != roleTypeVaultAdminToken && r.Type != roleTypeConsulToken
+}
+
+func getRole(ctx context.Context, s logical.Storage, name string) (*hcpRole, error) {
+	entry, err := s.Get(ctx, "roles/"+name)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	// roles written before renewable and mode existed were renewable and dynamic
+	role := &hcpRole{Renewable: true, Mode: roleModeDynamic, Type: roleTypeServicePrincipal}
+	if err := entry.DecodeJSON(&role); err != nil {
+		return nil, fmt.Errorf("error reading role configuration")
+	}
+
+	return role, nil
+}
+
+func saveRole(ctx context.Context, s logical.Storage, role *hcpRole) error {
+	entry, err := logical.StorageEntryJSON("roles/"+role.Name, role)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
 const pathRolesHelpSyn = `
 Manages the Vault role for generating HashiCorp Cloud Platform (HCP) credentials
 `
@@ -176,6 +960,57 @@ credentials. You can configure a role to manage a HCP service principal, and the
 generated service principal keys using the 'creds' endpoint.
 
 A HashiCorp Cloud Platform service principal can only have two active keys.
+
+Writing to an existing role only changes the fields that are provided, as does
+'vault patch'. Every role is checked against the guardrails on 'config' when it
+is written and again when credentials are issued.
+
+Types:
+
+  service_principal  A new service principal and key in the configured project.
+  project            A new project per lease, named by 'project_name_template',
+                     with a service principal bound to 'role'. Revocation
+                     deletes both. 'require_project_deletion' decides whether a
+                     project that cannot be deleted fails revocation or is left
+                     in place.
+  workload_identity  A new service principal with a workload identity provider
+                     for 'oidc_issuer' instead of a key.
+  vault_admin_token  An admin token for the HCP Vault Dedicated 'cluster_id'.
+                     The lease lasts the token's six hours and is not renewable.
+                     Revoking it early leaves the token valid.
+  consul_token       A root ACL token, or with 'consul_credential=client_config'
+                     the client configuration, of the HCP Consul Dedicated
+                     'cluster_id'. The lease does not bound the token, which
+                     HCP cannot revoke.
+
+Modes:
+
+  dynamic            A new service principal per credential. 'pool_size' keeps
+                     that many created and bound ahead of time.
+  shared_principal   Keys on 'shared_principal_count' long-lived service
+                     principals, at most two per principal.
+
+Projects:
+
+  allowed_projects   IDs, names or globs of projects callers may choose with
+                     the 'project' parameter of 'creds'.
+  project            The project to issue in, which callers cannot change.
+                     Identity templates are resolved for the requesting entity.
+
+Limits:
+
+  max_active_credentials  Active credentials the role may have at once.
+  require_justification   Refuses credentials without a 'justification'.
+  justification_max_ttl   Caps the leases of such a role below 'max_ttl'.
+
+Existing credentials:
+
+  existing_credentials  On a change of 'role', 'none' leaves issued credentials
+                        alone, 'propagate' rebinds them to the new HCP role and
+                        'revoke' revokes them in HCP. Their leases can no longer
+                        be renewed, but Vault lists them until they expire.
+  force                 On delete, revokes the credentials of the role in HCP
+                        first. Their leases can no longer be renewed.
 `
 
 const pathRolesListHelpSyn = `
@@ -185,3 +1020,13 @@ List the existing roles on the HashiCorp Cloud Platform (HCP) backend
 const pathRolesListHelpDesc = `
 Roles will be listed by the role name
 `
+
+const pathRoleCredentialsListHelpSyn = `
+List the active credentials issued by a role
+`
+
+const pathRoleCredentialsListHelpDesc = `
+Credentials will be listed by the client ID of their service principal key, along
+with the service principal name, issue time and lease expiry. Entries are added
+when credentials are issued and removed when their leases are revoked.
+`
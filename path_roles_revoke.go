@@ -0,0 +1,231 @@
+package hcpsecrets
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/models"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// bounds on parallel HCP deletes when revoking every credential of a role
+const (
+	defaultRevokeConcurrency = 5
+	maxRevokeConcurrency     = 32
+)
+
+func (b *hcpBackend) pathRoleRevokeAll() *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + framework.GenericNameRegex("name") + "/revoke-all",
+		DisplayAttrs: &framework.DisplayAttributes{
+			OperationPrefix: operationPrefix,
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the role",
+				Required:    true,
+			},
+			"concurrency": {
+				Type:        framework.TypeInt,
+				Description: "Maximum number of credentials revoked in parallel, from 1 to 32.",
+				Default:     defaultRevokeConcurrency,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathRoleRevokeAllWrite,
+				DisplayAttrs: &framework.DisplayAttributes{
+					OperationVerb:   "revoke",
+					OperationSuffix: "role-credentials",
+				},
+			},
+		},
+		HelpSynopsis:    pathRoleRevokeAllHelpSyn,
+		HelpDescription: pathRoleRevokeAllHelpDesc,
+	}
+}
+
+func (b *hcpBackend) pathRoleRevokeAllWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	concurrency := data.Get("concurrency").(int)
+	if concurrency < 1 || concurrency > maxRevokeConcurrency {
+		return logical.ErrorResponse("concurrency must be between 1 and %d", maxRevokeConcurrency), nil
+	}
+
+	revoked, failed, err := b.revokeRoleCredentials(ctx, req, name, concurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"revoked":      revoked,
+			"failed":       failed,
+			"lease_prefix": req.MountPoint + "creds/" + name,
+		},
+	}
+
+	if len(revoked) > 0 {
+		resp.AddWarning(leaseRemainWarning(req, name))
+	}
+
+	return resp, nil
+}
+
+// leaseRemainWarning tells the operator that the Vault leases of revoked
+// credentials stay listed until they expire, and how to remove them
+func leaseRemainWarning(req *logical.Request, name string) string {
+	return "HCP credentials were revoked and their leases can no longer be renewed, but Vault lists the leases until they expire. " +
+		"Run 'vault lease revoke -prefix " + req.MountPoint + "creds/" + name + "' to remove them now."
+}
+
+// revokeRoleCredentials deletes the HCP bindings, keys and service principals
+// of every active credential issued by a role and marks their records revoked.
+// Plugins cannot revoke Vault leases, so the records are kept to refuse
+// renewals of the leases until Vault revokes them, which then succeeds as
+// their HCP resources are gone.
+// It returns a report entry for each credential that was or was not revoked.
+func (b *hcpBackend) revokeRoleCredentials(ctx context.Context, req *logical.Request, name string, concurrency int) ([]map[string]interface{}, []map[string]interface{}, error) {
+	logger := b.Logger().With("vault_role", name, "operation", "revoke-all")
+
+	clientIDs, err := listRoleCredentials(ctx, req.Storage, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	creds := make([]*hcpCredential, 0, len(clientIDs))
+	principalIDs := map[string][]string{}
+	for _, clientID := range clientIDs {
+		cred, err := getCredential(ctx, req.Storage, clientID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cred == nil {
+			continue
+		}
+		creds = append(creds, cred)
+		// shared service principals stay bound to the role, and ephemeral
+		// projects are deleted with their bindings
+		if cred.ServicePrincipalID != "" && !cred.Shared && !cred.EphemeralProject {
+			projectID := cfg.ProjectID
+			if cred.ProjectID != "" {
+				projectID = cred.ProjectID
+			}
+			principalIDs[projectID] = append(principalIDs[projectID], cred.ServicePrincipalID)
+		}
+	}
+
+	revoked := []map[string]interface{}{}
+	failed := []map[string]interface{}{}
+	if len(creds) == 0 {
+		return revoked, failed, nil
+	}
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		logger.Error("failed to create HCP client", "error", err)
+		return nil, nil, err
+	}
+
+	logger.Info("revoking all credentials issued by role", "count", len(creds))
+
+	// remove every binding in one policy update per project, deleting the
+	// principals below still cuts off access if this fails
+	for projectID, ids := range principalIDs {
+		if err := removeProjectServicePrincipalRoles(cl, projectID, ids...); err != nil {
+			logger.Error("failed to remove IAM bindings", "project_id", projectID, "error", err)
+			failed = append(failed, map[string]interface{}{
+				"step":       "iam_policy",
+				"project_id": projectID,
+				"error":      err.Error(),
+			})
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+
+	for _, cred := range creds {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(cred *hcpCredential) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			var err error
+			switch {
+			case cred.EphemeralProject:
+				err = destroyEphemeralProject(cl, cred.ProjectID, true, logger.With("project_id", cred.ProjectID))
+			case cred.WorkloadIdentityProvider != "":
+				err = deleteWorkloadIdentityAndPrincipal(cl, cred.WorkloadIdentityProvider, cred.ServicePrincipal)
+			case cred.Shared:
+				err = deleteServicePrincipalKey(cl, &models.HashicorpCloudIamServicePrincipalKey{ResourceName: cred.KeyResourceName})
+				if isNotFound(err) {
+					err = nil
+				}
+			default:
+				err = deleteServicePrincipalAndKeys(cl, cred.ServicePrincipal, cred.KeyResourceName)
+			}
+			if err == nil {
+				err = revokeCredentialRecord(ctx, req.Storage, cred)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				logger.Error("failed to revoke credential", "client_id", cred.ClientID, "service_principal", cred.ServicePrincipal, "error", err)
+				failed = append(failed, map[string]interface{}{
+					"step":              "service_principal",
+					"client_id":         cred.ClientID,
+					"service_principal": cred.ServicePrincipal,
+					"error":             err.Error(),
+				})
+				return
+			}
+
+			logger.Debug("revoked credential", "client_id", cred.ClientID, "service_principal", cred.ServicePrincipal)
+			revoked = append(revoked, map[string]interface{}{
+				"client_id":         cred.ClientID,
+				"service_principal": cred.ServicePrincipal,
+				"lease_path":        cred.LeasePath,
+			})
+		}(cred)
+	}
+	wg.Wait()
+
+	logger.Info("revoked credentials issued by role", "revoked", len(revoked), "failed", len(failed))
+	return revoked, failed, nil
+}
+
+const pathRoleRevokeAllHelpSyn = `
+Immediately revoke every HashiCorp Cloud Platform (HCP) credential issued by a role.
+`
+
+const pathRoleRevokeAllHelpDesc = `
+This path revokes every active credential of a role in HCP: it removes their
+service principals from the IAM policy of the project they were issued in, and
+deletes their keys and service principals. Credentials of roles in
+'shared_principal' mode only have their key deleted, the projects created by
+'project' roles are deleted, and workload identity providers are deleted with
+their service principals. The response lists the credentials that were revoked
+and any failures.
+
+Plugins cannot revoke Vault leases themselves. The revoked credentials are
+recorded so that renewing their leases fails and 'lookup' reports them as
+revoked, but Vault lists the leases until they expire. Use
+'vault lease revoke -prefix' with the returned 'lease_prefix' to remove them
+now, which succeeds as their HCP resources are already gone.
+`
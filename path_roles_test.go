@@ -0,0 +1,519 @@
+package hcpsecrets
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRoleLeaseMaxTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		role hcpRole
+		want time.Duration
+	}{
+		{
+			name: "unset",
+			role: hcpRole{},
+			want: 0,
+		},
+		{
+			name: "max_ttl only",
+			role: hcpRole{MaxTTL: time.Hour},
+			want: time.Hour,
+		},
+		{
+			name: "justification_max_ttl below max_ttl",
+			role: hcpRole{MaxTTL: time.Hour, JustificationMaxTTL: 30 * time.Minute},
+			want: 30 * time.Minute,
+		},
+		{
+			name: "justification_max_ttl above max_ttl",
+			role: hcpRole{MaxTTL: time.Hour, JustificationMaxTTL: 2 * time.Hour},
+			want: time.Hour,
+		},
+		{
+			name: "justification_max_ttl without max_ttl",
+			role: hcpRole{JustificationMaxTTL: 30 * time.Minute},
+			want: 30 * time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.role.leaseMaxTTL(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoleLeaseTTL(t *testing.T) {
+	sys := &logical.StaticSystemView{
+		DefaultLeaseTTLVal: time.Hour,
+		MaxLeaseTTLVal:     4 * time.Hour,
+	}
+
+	tests := []struct {
+		name      string
+		role      hcpRole
+		requested time.Duration
+		want      time.Duration
+		warns     bool
+	}{
+		{
+			name: "mount default",
+			role: hcpRole{},
+			want: time.Hour,
+		},
+		{
+			name: "role ttl",
+			role: hcpRole{TTL: 15 * time.Minute},
+			want: 15 * time.Minute,
+		},
+		{
+			name:      "requested ttl",
+			role:      hcpRole{TTL: 15 * time.Minute, MaxTTL: 2 * time.Hour},
+			requested: 90 * time.Minute,
+			want:      90 * time.Minute,
+		},
+		{
+			name:      "requested ttl capped by role max_ttl",
+			role:      hcpRole{MaxTTL: 2 * time.Hour},
+			requested: 3 * time.Hour,
+			want:      2 * time.Hour,
+			warns:     true,
+		},
+		{
+			name:      "requested ttl capped by justification_max_ttl",
+			role:      hcpRole{MaxTTL: 2 * time.Hour, RequireJustification: true, JustificationMaxTTL: 30 * time.Minute},
+			requested: time.Hour,
+			want:      30 * time.Minute,
+			warns:     true,
+		},
+		{
+			name:  "role ttl capped by justification_max_ttl",
+			role:  hcpRole{TTL: time.Hour, RequireJustification: true, JustificationMaxTTL: 30 * time.Minute},
+			want:  30 * time.Minute,
+			warns: true,
+		},
+		{
+			name:      "requested ttl capped by mount max",
+			role:      hcpRole{},
+			requested: 8 * time.Hour,
+			want:      4 * time.Hour,
+			warns:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, warnings, err := framework.CalculateTTL(sys, tt.requested, tt.role.TTL, 0, tt.role.leaseMaxTTL(), 0, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ttl != tt.want {
+				t.Errorf("got %s, want %s", ttl, tt.want)
+			}
+			if (len(warnings) > 0) != tt.warns {
+				t.Errorf("got warnings %v, want warnings %t", warnings, tt.warns)
+			}
+		})
+	}
+}
+
+func TestRoleCredentialsList(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+
+	// "ci" is a prefix of "ci-prod", whose credentials must not be listed under it
+	creds := []*hcpCredential{
+		{ClientID: "ci-1", ServicePrincipal: "sp/ci-1", ServicePrincipalName: "v-ci-1", VaultRole: "ci"},
+		{ClientID: "ci-2", ServicePrincipal: "sp/ci-2", ServicePrincipalName: "v-ci-2", VaultRole: "ci"},
+		{ClientID: "ci-prod-1", ServicePrincipal: "sp/ci-prod-1", ServicePrincipalName: "v-ci-prod-1", VaultRole: "ci-prod"},
+	}
+	for _, cred := range creds {
+		if err := saveCredential(ctx, s, cred); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		role string
+		want []string
+	}{
+		{role: "ci", want: []string{"ci-1", "ci-2"}},
+		{role: "ci-prod", want: []string{"ci-prod-1"}},
+		{role: "c", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.ListOperation,
+				Path:      "roles/" + tt.role + "/credentials/",
+				Storage:   s,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, _ := resp.Data["keys"].([]string)
+			sort.Strings(got)
+			if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+
+			for _, clientID := range got {
+				info, _ := resp.Data["key_info"].(map[string]interface{})[clientID].(map[string]interface{})
+				if info["service_principal_name"] != "v-"+clientID {
+					t.Errorf("got key info %v for %q", info, clientID)
+				}
+			}
+		})
+	}
+}
+
+func TestRoleWriteExistingCredentials(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+
+	entry, err := logical.StorageEntryJSON("config", &hcpConfig{OrganizationID: "org", ProjectID: "project"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "roles/ci",
+			Storage:   s,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := write(map[string]interface{}{"role": "viewer"}); resp != nil && resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+
+	tests := []struct {
+		name      string
+		data      map[string]interface{}
+		wantMode  string
+		wantError bool
+	}{
+		{
+			name:     "revoke",
+			data:     map[string]interface{}{"role": "contributor", "existing_credentials": "revoke"},
+			wantMode: "revoke",
+		},
+		{
+			name:     "propagate",
+			data:     map[string]interface{}{"role": "viewer", "existing_credentials": "propagate"},
+			wantMode: "propagate",
+		},
+		{
+			name:      "invalid mode",
+			data:      map[string]interface{}{"role": "contributor", "existing_credentials": "delete"},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := write(tt.data)
+
+			if tt.wantError {
+				if resp == nil || !resp.IsError() {
+					t.Fatalf("got %v, want an error response", resp)
+				}
+				return
+			}
+
+			if resp == nil || resp.IsError() {
+				t.Fatalf("got %v, want a report of existing credentials", resp)
+			}
+			result, _ := resp.Data["existing_credentials"].(map[string]interface{})
+			if result["mode"] != tt.wantMode {
+				t.Errorf("got %v, want mode %q", result, tt.wantMode)
+			}
+		})
+	}
+}
+
+func TestRoleDelete(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+
+	entry, err := logical.StorageEntryJSON("config", &hcpConfig{OrganizationID: "org", ProjectID: "project"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeServicePrincipalService()
+	b.client = &hcpClient{ServicePrincipals: fake}
+
+	if err := saveRole(ctx, s, &hcpRole{Name: "ci", Role: "viewer", Mode: roleModeDynamic, Type: roleTypeServicePrincipal}); err != nil {
+		t.Fatal(err)
+	}
+
+	var creds []*hcpCredential
+	for _, name := range []string{"v-ci-1", "v-ci-2"} {
+		sp := fake.addPrincipal("project", name, 1)
+		cred := &hcpCredential{
+			ClientID:         fake.keys[sp.ResourceName][0].ClientID,
+			KeyResourceName:  fake.keys[sp.ResourceName][0].ResourceName,
+			ServicePrincipal: sp.ResourceName,
+			VaultRole:        "ci",
+		}
+		if err := saveCredential(ctx, s, cred); err != nil {
+			t.Fatal(err)
+		}
+		creds = append(creds, cred)
+	}
+
+	del := func(force bool) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "roles/ci",
+			Storage:   s,
+			Data:      map[string]interface{}{"force": force},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// without force the role and its credentials are left alone
+	resp := del(false)
+	if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "has 2 active credentials") {
+		t.Fatalf("got %v, want an error about active credentials", resp)
+	}
+	if role, err := getRole(ctx, s, "ci"); err != nil || role == nil {
+		t.Fatalf("got role %v, error %v, want the role kept", role, err)
+	}
+	for _, cred := range creds {
+		if n := fake.keyCount(cred.ServicePrincipal); n != 1 {
+			t.Errorf("got %d keys on %q, want 1", n, cred.ServicePrincipal)
+		}
+	}
+
+	// with force the credentials are revoked in HCP before the role is deleted
+	resp = del(true)
+	if resp == nil || resp.IsError() {
+		t.Fatalf("got %v, want the role deleted", resp)
+	}
+	if revoked, _ := resp.Data["revoked"].([]map[string]interface{}); len(revoked) != 2 {
+		t.Errorf("got revoked %v, want 2 credentials", resp.Data["revoked"])
+	}
+	if len(resp.Warnings) == 0 {
+		t.Error("got no warnings, want a warning about remaining leases")
+	}
+	if role, err := getRole(ctx, s, "ci"); err != nil || role != nil {
+		t.Fatalf("got role %v, error %v, want the role deleted", role, err)
+	}
+	for _, cred := range creds {
+		if n := fake.keyCount(cred.ServicePrincipal); n != -1 {
+			t.Errorf("got %d keys on %q, want the service principal deleted", n, cred.ServicePrincipal)
+		}
+
+		got, err := getCredential(ctx, s, cred.ClientID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || got.RevokedAt.IsZero() {
+			t.Errorf("got credential %v, want it marked revoked", got)
+		}
+	}
+}
+
+func TestRoleWritePatch(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+
+	entry, err := logical.StorageEntryJSON("config", &hcpConfig{OrganizationID: "org", ProjectID: "project"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(op logical.Operation, name string, data map[string]interface{}) (*logical.Response, error) {
+		t.Helper()
+		req := &logical.Request{
+			Operation: op,
+			Path:      "roles/" + name,
+			Storage:   s,
+			Data:      data,
+		}
+
+		// the router checks existence to tell creates and updates apart
+		if op == logical.UpdateOperation {
+			_, exists, err := b.HandleExistenceCheck(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !exists {
+				req.Operation = logical.CreateOperation
+			}
+		}
+
+		return b.HandleRequest(ctx, req)
+	}
+
+	mustRole := func(name string) *hcpRole {
+		t.Helper()
+		role, err := getRole(ctx, s, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role == nil {
+			t.Fatalf("role %q does not exist", name)
+		}
+		return role
+	}
+
+	// a write to a missing role creates it with the defaults
+	if resp, err := request(logical.UpdateOperation, "ci", map[string]interface{}{"role": "viewer", "ttl": "30m", "max_ttl": "2h"}); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("got %v, error %v, want the role created", resp, err)
+	}
+	role := mustRole("ci")
+	if !role.Renewable || role.Mode != roleModeDynamic || role.Type != roleTypeServicePrincipal {
+		t.Errorf("got %+v, want a renewable dynamic service_principal role", role)
+	}
+
+	// patches never create roles
+	resp, err := request(logical.PatchOperation, "missing", map[string]interface{}{"ttl": "15m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || resp.Data[logical.HTTPStatusCode] != http.StatusNotFound {
+		t.Fatalf("got %v, want a 404 response", resp)
+	}
+	if role, err := getRole(ctx, s, "missing"); err != nil || role != nil {
+		t.Fatalf("got role %v, error %v, want no role", role, err)
+	}
+
+	tests := []struct {
+		name      string
+		op        logical.Operation
+		role      string
+		data      map[string]interface{}
+		wantError string
+		check     func(*testing.T, *hcpRole)
+	}{
+		{
+			name: "patch ttl",
+			op:   logical.PatchOperation,
+			role: "ci",
+			data: map[string]interface{}{"ttl": "15m"},
+			check: func(t *testing.T, r *hcpRole) {
+				if r.TTL != 15*time.Minute || r.MaxTTL != 2*time.Hour || r.Role != "viewer" || !r.Renewable {
+					t.Errorf("got %+v, want only ttl changed", r)
+				}
+			},
+		},
+		{
+			name: "update without role",
+			op:   logical.UpdateOperation,
+			role: "ci",
+			data: map[string]interface{}{"renewable": false},
+			check: func(t *testing.T, r *hcpRole) {
+				if r.Renewable || r.TTL != 15*time.Minute || r.MaxTTL != 2*time.Hour || r.Role != "viewer" {
+					t.Errorf("got %+v, want only renewable changed", r)
+				}
+			},
+		},
+		{
+			name:      "ttl above max_ttl",
+			op:        logical.PatchOperation,
+			role:      "ci",
+			data:      map[string]interface{}{"ttl": "3h"},
+			wantError: "ttl cannot be greater than max_ttl",
+		},
+		{
+			name:      "max_ttl below ttl",
+			op:        logical.UpdateOperation,
+			role:      "ci",
+			data:      map[string]interface{}{"max_ttl": "10m"},
+			wantError: "ttl cannot be greater than max_ttl",
+		},
+		{
+			name:      "justification_max_ttl without require_justification",
+			op:        logical.PatchOperation,
+			role:      "ci",
+			data:      map[string]interface{}{"justification_max_ttl": "10m"},
+			wantError: "justification_max_ttl can only be set with require_justification",
+		},
+		{
+			name:      "create without role",
+			op:        logical.UpdateOperation,
+			role:      "new",
+			data:      map[string]interface{}{"ttl": "15m"},
+			wantError: "role is empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, err := getRole(ctx, s, tt.role)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := request(tt.op, tt.role, tt.data)
+			if err != nil && tt.wantError == "" {
+				t.Fatal(err)
+			}
+
+			if tt.wantError != "" {
+				if err == nil && (resp == nil || !resp.IsError()) {
+					t.Fatalf("got %v, want an error containing %q", resp, tt.wantError)
+				}
+				if err == nil {
+					err = resp.Error()
+				}
+				if !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("got error %q, want %q", err, tt.wantError)
+				}
+
+				// a rejected write leaves the stored role untouched
+				after, err := getRole(ctx, s, tt.role)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(before, after) {
+					t.Errorf("got %+v, want %+v", after, before)
+				}
+				return
+			}
+
+			if resp != nil && resp.IsError() {
+				t.Fatal(resp.Error())
+			}
+			tt.check(t, mustRole(tt.role))
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package hcpsecrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/models"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const poolStoragePrefix = "pool/"
+
+// pooledServicePrincipal is a service principal created and bound to its HCP
+// role ahead of time, waiting to be handed out by creds/<name>
+type pooledServicePrincipal struct {
+	ID           string    `json:"id"`
+	ResourceName string    `json:"resource_name"`
+	Name         string    `json:"name"`
+	HCPRole      string    `json:"hcp_role"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (b *hcpBackend) poolLock(role string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.poolLocks, role)
+}
+
+func listPool(ctx context.Context, s logical.Storage, role string) ([]*pooledServicePrincipal, error) {
+	ids, err := s.List(ctx, poolStoragePrefix+role+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	pool := make([]*pooledServicePrincipal, 0, len(ids))
+	for _, id := range ids {
+		entry, err := s.Get(ctx, poolStoragePrefix+role+"/"+id)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+
+		sp := new(pooledServicePrincipal)
+		if err := entry.DecodeJSON(&sp); err != nil {
+			return nil, fmt.Errorf("error reading pooled service principal: %w", err)
+		}
+		pool = append(pool, sp)
+	}
+
+	return pool, nil
+}
+
+// countPooled returns the number of pooled service principals across all roles
+func countPooled(ctx context.Context, s logical.Storage) (int, error) {
+	roles, err := s.List(ctx, poolStoragePrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, role := range roles {
+		ids, err := s.List(ctx, poolStoragePrefix+role)
+		if err != nil {
+			return 0, err
+		}
+		count += len(ids)
+	}
+
+	return count, nil
+}
+
+// takePooledServicePrincipal removes and returns a pooled service principal
+// bound to the role's current HCP role, or nil if none is available
+func (b *hcpBackend) takePooledServicePrincipal(ctx context.Context, req *logical.Request, role *hcpRole) (*pooledServicePrincipal, error) {
+	if role.PoolSize == 0 {
+		return nil, nil
+	}
+
+	lock := b.poolLock(role.Name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	pool, err := listPool(ctx, req.Storage, role.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sp := range pool {
+		// principals bound to a previous HCP role are replaced by the periodic function
+		if sp.HCPRole != role.Role {
+			continue
+		}
+
+		if err := req.Storage.Delete(ctx, poolStoragePrefix+role.Name+"/"+sp.ID); err != nil {
+			return nil, err
+		}
+		return sp, nil
+	}
+
+	return nil, nil
+}
+
+// returnPooledServicePrincipal puts back a service principal taken from the
+// pool whose credential could not be issued
+func (b *hcpBackend) returnPooledServicePrincipal(ctx context.Context, req *logical.Request, role string, sp *pooledServicePrincipal) error {
+	lock := b.poolLock(role)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return savePooledServicePrincipal(ctx, req.Storage, role, sp)
+}
+
+func savePooledServicePrincipal(ctx context.Context, s logical.Storage, role string, sp *pooledServicePrincipal) error {
+	entry, err := logical.StorageEntryJSON(poolStoragePrefix+role+"/"+sp.ID, sp)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// periodicFunc keeps the service principal pools of all roles filled
+func (b *hcpBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	// only the active node of the primary cluster can write to HCP and storage
+	if b.System().ReplicationState().HasState(consts.ReplicationPerformanceSecondary | consts.ReplicationPerformanceStandby) {
+		return nil
+	}
+
+	roles, err := req.Storage.List(ctx, "roles/")
+	if err != nil {
+		return err
+	}
+
+	pooledRoles, err := req.Storage.List(ctx, poolStoragePrefix)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]struct{}, len(roles)+len(pooledRoles))
+	for _, name := range roles {
+		names[name] = struct{}{}
+	}
+	for _, name := range pooledRoles {
+		names[strings.TrimSuffix(name, "/")] = struct{}{}
+	}
+
+	var cl *hcpClient
+	for name := range names {
+		role, err := getRole(ctx, req.Storage, name)
+		if err != nil {
+			return err
+		}
+
+		// deleted roles are drained with a pool size of zero
+		if role == nil {
+			role = &hcpRole{Name: name}
+		}
+
+		pool, err := listPool(ctx, req.Storage, name)
+		if err != nil {
+			return err
+		}
+
+		if role.PoolSize == 0 && len(pool) == 0 {
+			continue
+		}
+
+		if cl == nil {
+			if cl, err = b.getClient(ctx, req.Storage); err != nil {
+				return err
+			}
+		}
+
+		if err := b.refillPool(ctx, req, cl, role); err != nil {
+			b.Logger().Error("failed to refill service principal pool", "vault_role", name, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// refillPool destroys pooled service principals that are stale or beyond the
+// role's pool size, then creates new ones until the pool is full or the
+// project has no free service principal slots
+func (b *hcpBackend) refillPool(ctx context.Context, req *logical.Request, cl *hcpClient, role *hcpRole) error {
+	logger := b.Logger().With("vault_role", role.Name, "hcp_role", role.Role, "pool_size", role.PoolSize)
+
+	lock := b.poolLock(role.Name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	pool, err := listPool(ctx, req.Storage, role.Name)
+	if err != nil {
+		return err
+	}
+
+	size := 0
+	for _, sp := range pool {
+		if sp.HCPRole == role.Role && size < role.PoolSize {
+			size++
+			continue
+		}
+
+		logger.Debug("destroying pooled service principal", "service_principal", sp.ResourceName)
+		if err := destroyPooledServicePrincipal(ctx, req, cl, role.Name, sp); err != nil {
+			return err
+		}
+	}
+
+	// pooled principals are only handed out once issuance passes the
+	// guardrails, but none are created for a role outside them
+	if size < role.PoolSize {
+		cfg, err := getConfig(ctx, req.Storage)
+		if err != nil {
+			return err
+		}
+		if err := cfg.checkRole(role, scopeConfiguredProject); err != nil {
+			logger.Warn("service principal pool not refilled, role is outside the guardrails", "error", err)
+			return nil
+		}
+	}
+
+	for ; size < role.PoolSize; size++ {
+		principals, err := listServicePrincipals(ctx, req, cl)
+		if err != nil {
+			return err
+		}
+
+		if len(principals) >= projectServicePrincipalLimit {
+			logger.Warn("service principal pool not full, project limit reached", "pooled", size, "limit", projectServicePrincipalLimit)
+			return nil
+		}
+
+		name := servicePrincipalName(role.Name, "pool")
+		sp, err := createServicePrincipal(ctx, req, cl, name)
+		if err != nil {
+			return err
+		}
+
+		if err := assignServicePrincipalRole(ctx, req, cl, sp, role.Role); err != nil {
+			// do not leave an unbound principal behind in the project
+			if delErr := deleteServicePrincipal(cl, sp); delErr != nil {
+				logger.Error("failed to delete unbound service principal", "service_principal", sp.ResourceName, "error", delErr)
+			}
+			return err
+		}
+
+		pooled := &pooledServicePrincipal{
+			ID:           sp.ID,
+			ResourceName: sp.ResourceName,
+			Name:         name,
+			HCPRole:      role.Role,
+			CreatedAt:    time.Now().UTC(),
+		}
+		if err := savePooledServicePrincipal(ctx, req.Storage, role.Name, pooled); err != nil {
+			return err
+		}
+
+		logger.Debug("added service principal to pool", "service_principal", sp.ResourceName)
+	}
+
+	return nil
+}
+
+// drainPool destroys every pooled service principal of a role
+func (b *hcpBackend) drainPool(ctx context.Context, req *logical.Request, role string) error {
+	lock := b.poolLock(role)
+	lock.Lock()
+	defer lock.Unlock()
+
+	pool, err := listPool(ctx, req.Storage, role)
+	if err != nil {
+		return err
+	}
+
+	if len(pool) == 0 {
+		return nil
+	}
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	for _, sp := range pool {
+		if err := destroyPooledServicePrincipal(ctx, req, cl, role, sp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func destroyPooledServicePrincipal(ctx context.Context, req *logical.Request, cl *hcpClient, role string, sp *pooledServicePrincipal) error {
+	if err := deleteServicePrincipal(cl, &models.HashicorpCloudIamServicePrincipal{ResourceName: sp.ResourceName}); err != nil && !isNotFound(err) {
+		return err
+	}
+	return req.Storage.Delete(ctx, poolStoragePrefix+role+"/"+sp.ID)
+}
@@ -0,0 +1,273 @@
+package hcpsecrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	resourcemodels "github.com/hashicorp/hcp-sdk-go/clients/cloud-resource-manager/stable/2019-12-10/models"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/template"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	project "github.com/hashicorp/hcp-sdk-go/clients/cloud-resource-manager/stable/2019-12-10/client/project_service"
+)
+
+const secretTypeProject = "hcp-project"
+
+// maximum length of a project name accepted by HCP
+const projectNameMaxLen = 40
+
+const defaultProjectNameTemplate = `vault-{{ .RoleName | truncate 14 }}-{{ unix_time }}-{{ random 4 | lowercase }}`
+
+// projectNameData is the data available to a role's project name template
+type projectNameData struct {
+	RoleName    string
+	DisplayName string
+}
+
+func (b *hcpBackend) hcpEphemeralProject() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeProject,
+		Fields: map[string]*framework.FieldSchema{
+			"project_id": {
+				Type:        framework.TypeString,
+				Description: "ID of the HCP project created for the lease",
+			},
+			"client_id": {
+				Type:        framework.TypeString,
+				Description: "Client ID of the project's admin service principal",
+			},
+			"client_secret": {
+				Type:        framework.TypeString,
+				Description: "Client secret of the project's admin service principal",
+			},
+		},
+		Revoke: b.revokeEphemeralProject,
+		Renew:  b.renewCredentials,
+	}
+}
+
+func generateProjectName(tmpl string, role *hcpRole, requester hcpRequester) (string, error) {
+	t, err := template.NewTemplate(template.Template(tmpl))
+	if err != nil {
+		return "", fmt.Errorf("invalid project_name_template: %w", err)
+	}
+
+	name, err := t.Generate(projectNameData{
+		RoleName:    role.Name,
+		DisplayName: requester.DisplayName,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error generating project name: %w", err)
+	}
+
+	if len(name) > projectNameMaxLen {
+		name = name[:projectNameMaxLen]
+	}
+	if name == "" {
+		return "", errors.New("project_name_template generated an empty project name")
+	}
+
+	return name, nil
+}
+
+// issueEphemeralProject creates a new project for the lease along with a
+// service principal bound to the role's HCP role in that project
+func (b *hcpBackend) issueEphemeralProject(ctx context.Context, req *logical.Request, cl *hcpClient, role *hcpRole, ttl time.Duration, requester hcpRequester, logger hclog.Logger) (*logical.Response, error) {
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	projectName, err := generateProjectName(role.ProjectNameTemplate, role, requester)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("creating project", "project_name", projectName)
+	p := project.NewProjectServiceCreateParams()
+	p.Body = &resourcemodels.HashicorpCloudResourcemanagerProjectCreateRequest{
+		Name:        projectName,
+		Description: role.ProjectDescription,
+		Parent: &resourcemodels.HashicorpCloudResourcemanagerResourceID{
+			ID:   cfg.OrganizationID,
+			Type: resourcemodels.HashicorpCloudResourcemanagerResourceIDResourceTypeORGANIZATION.Pointer(),
+		},
+	}
+
+	r, err := cl.Project.ProjectServiceCreate(p, nil)
+	if err != nil {
+		logger.Error("failed to create project", "error", err)
+		return nil, err
+	}
+
+	projectID := r.Payload.Project.ID
+	logger = logger.With("project_id", projectID)
+
+	// do not leave a project behind if the rest of issuance fails
+	cleanup := func() {
+		if err := destroyEphemeralProject(cl, projectID, role.RequireProjectDeletion, logger); err != nil {
+			logger.Error("failed to delete project after failed issuance", "error", err)
+		}
+	}
+
+	spName := servicePrincipalName(role.Name, requester.nameTags()...)
+	sp, err := createProjectServicePrincipal(cl, projectID, spName)
+	if err != nil {
+		logger.Error("failed to create service principal", "error", err)
+		cleanup()
+		return nil, err
+	}
+	logger = logger.With("service_principal", sp.ResourceName)
+
+	if err := assignProjectServicePrincipalRole(cl, projectID, sp, role.Role); err != nil {
+		logger.Error("failed to assign role to service principal", "error", err)
+		cleanup()
+		return nil, err
+	}
+
+	spk, err := createServicePrincipalKey(cl, sp)
+	if err != nil {
+		logger.Error("failed to create service principal key", "error", err)
+		cleanup()
+		return nil, err
+	}
+
+	issuedAt := time.Now().UTC()
+	cred := &hcpCredential{
+		ClientID:             spk.Key.ClientID,
+		KeyResourceName:      spk.Key.ResourceName,
+		ServicePrincipal:     sp.ResourceName,
+		ServicePrincipalName: spName,
+		ServicePrincipalID:   sp.ID,
+		VaultRole:            role.Name,
+		Requester:            requester,
+		IssuedAt:             issuedAt,
+		ExpiresAt:            issuedAt.Add(ttl),
+		ProjectID:            projectID,
+		EphemeralProject:     true,
+		LeasePath:            req.MountPoint + req.Path,
+	}
+	if err := saveCredential(ctx, req.Storage, cred); err != nil {
+		logger.Error("failed to save credential record", "client_id", cred.ClientID, "error", err)
+		cleanup()
+		return nil, err
+	}
+
+	logger.Info("created project", "project_name", projectName, "client_id", spk.Key.ClientID)
+
+	internalData := map[string]interface{}{
+		"vault_role":               role.Name,
+		"project_id":               projectID,
+		"require_project_deletion": role.RequireProjectDeletion,
+		"client_id":                spk.Key.ClientID,
+		"resource_name":            spk.Key.ResourceName,
+		"service_principal":        sp.ResourceName,
+		"service_principal_id":     sp.ID,
+		"created_at":               spk.Key.CreatedAt,
+	}
+	for k, v := range requester.internalData() {
+		internalData[k] = v
+	}
+
+	resp := b.Secret(secretTypeProject).Response(
+		// data
+		map[string]interface{}{
+			"organization_id": cfg.OrganizationID,
+			"project_id":      projectID,
+			"project_name":    projectName,
+			"client_id":       spk.Key.ClientID,
+			"client_secret":   spk.ClientSecret,
+		},
+		// internal data
+		internalData,
+	)
+
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = role.leaseMaxTTL()
+	resp.Secret.Renewable = role.Renewable
+
+	return resp, nil
+}
+
+func (b *hcpBackend) revokeEphemeralProject(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	projectID, ok := req.Secret.InternalData["project_id"].(string)
+	if !ok {
+		return nil, errors.New("internal data 'project_id' not found")
+	}
+
+	require, _ := req.Secret.InternalData["require_project_deletion"].(bool)
+
+	logger := b.Logger().With("vault_role", req.Secret.InternalData["vault_role"], "project_id", projectID).With(requesterFromInternalData(req.Secret.InternalData).logArgs()...)
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		logger.Error("failed to create HCP client", "error", err)
+		return nil, err
+	}
+
+	if err := destroyEphemeralProject(cl, projectID, require, logger); err != nil {
+		return nil, err
+	}
+
+	if clientID, ok := req.Secret.InternalData["client_id"].(string); ok {
+		cred := &hcpCredential{ClientID: clientID}
+		cred.ServicePrincipal, _ = req.Secret.InternalData["service_principal"].(string)
+		cred.VaultRole, _ = req.Secret.InternalData["vault_role"].(string)
+
+		if err := deleteCredential(ctx, req.Storage, cred); err != nil {
+			logger.Error("failed to delete credential record", "client_id", clientID, "error", err)
+			return nil, err
+		}
+	}
+
+	logger.Info("revoked project")
+	return nil, nil
+}
+
+// destroyEphemeralProject deletes the keys of every service principal in a
+// project, then the principals and the project itself. HCP only deletes empty projects, so when deletion
+// is not required a project that still holds other resources is left behind.
+func destroyEphemeralProject(cl *hcpClient, projectID string, require bool, logger hclog.Logger) error {
+	principals, err := listProjectServicePrincipals(cl, projectID)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("error listing project service principals: %w", err)
+	}
+
+	for _, sp := range principals {
+		keys, err := listServicePrincipalKeys(cl, sp.ResourceName)
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("error listing service principal keys: %w", err)
+		}
+
+		keyResourceNames := make([]string, 0, len(keys))
+		for _, key := range keys {
+			keyResourceNames = append(keyResourceNames, key.ResourceName)
+		}
+
+		logger.Debug("deleting service principal and keys", "service_principal", sp.ResourceName, "keys", len(keyResourceNames))
+		if err := deleteServicePrincipalAndKeys(cl, sp.ResourceName, keyResourceNames...); err != nil {
+			return err
+		}
+	}
+
+	p := project.NewProjectServiceDeleteParams()
+	p.ID = projectID
+
+	logger.Debug("deleting project")
+	if _, err := cl.Project.ProjectServiceDelete(p, nil); err != nil && !isNotFound(err) {
+		if require {
+			logger.Error("failed to delete project", "error", err)
+			return fmt.Errorf("error deleting project: %w", err)
+		}
+		logger.Warn("project could not be deleted and was left in place", "error", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,286 @@
+package hcpsecrets
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/models"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const sharedStoragePrefix = "shared/"
+
+// maximum number of keys HCP allows on a service principal
+const servicePrincipalKeyLimit = 2
+
+// sharedServicePrincipal is a long-lived service principal owned by a role in
+// shared_principal mode, bound to the role's HCP role once and issued keys only
+type sharedServicePrincipal struct {
+	Index        int       `json:"index"`
+	ID           string    `json:"id"`
+	ResourceName string    `json:"resource_name"`
+	Name         string    `json:"name"`
+	HCPRole      string    `json:"hcp_role"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func listSharedServicePrincipals(ctx context.Context, s logical.Storage, role string) ([]*sharedServicePrincipal, error) {
+	keys, err := s.List(ctx, sharedStoragePrefix+role+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	shared := make([]*sharedServicePrincipal, 0, len(keys))
+	for _, key := range keys {
+		entry, err := s.Get(ctx, sharedStoragePrefix+role+"/"+key)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+
+		sp := new(sharedServicePrincipal)
+		if err := entry.DecodeJSON(&sp); err != nil {
+			return nil, fmt.Errorf("error reading shared service principal: %w", err)
+		}
+		shared = append(shared, sp)
+	}
+
+	return shared, nil
+}
+
+func saveSharedServicePrincipal(ctx context.Context, s logical.Storage, role string, sp *sharedServicePrincipal) error {
+	entry, err := logical.StorageEntryJSON(sharedStoragePrefix+role+"/"+strconv.Itoa(sp.Index), sp)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// sharedKeyCounts returns the number of active keys issued on each shared
+// service principal of a role, keyed by resource name
+func sharedKeyCounts(ctx context.Context, s logical.Storage, role string) (map[string]int, error) {
+	clientIDs, err := listRoleCredentials(ctx, s, role)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, clientID := range clientIDs {
+		cred, err := getCredential(ctx, s, clientID)
+		if err != nil {
+			return nil, err
+		}
+		if cred == nil || !cred.Shared {
+			continue
+		}
+		counts[cred.ServicePrincipal]++
+	}
+
+	return counts, nil
+}
+
+// acquireSharedServicePrincipal returns a shared service principal of the role
+// with room for another key, creating and binding a new shard if needed. The
+// caller must hold lock, the role lock, which is released while waiting for a
+// free service principal slot.
+func (b *hcpBackend) acquireSharedServicePrincipal(ctx context.Context, req *logical.Request, cl *hcpClient, role *hcpRole, lock *locksutil.LockEntry, wait time.Duration) (*sharedServicePrincipal, error) {
+	logger := b.Logger().With("vault_role", role.Name, "hcp_role", role.Role)
+
+	for {
+		shared, err := listSharedServicePrincipals(ctx, req.Storage, role.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		byIndex := make(map[int]*sharedServicePrincipal, len(shared))
+		counts := make(map[string]int, len(shared))
+		for _, sp := range shared {
+			if sp.Index >= role.SharedPrincipalCount {
+				continue
+			}
+
+			// keys created outside Vault also count towards the limit
+			keys, err := listServicePrincipalKeys(cl, sp.ResourceName)
+			if isNotFound(err) {
+				logger.Warn("shared service principal no longer exists, it will be recreated", "service_principal", sp.ResourceName)
+				if err := req.Storage.Delete(ctx, sharedStoragePrefix+role.Name+"/"+strconv.Itoa(sp.Index)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			byIndex[sp.Index] = sp
+			counts[sp.ResourceName] = len(keys)
+		}
+
+		// use the least loaded existing shard, then create missing shards
+		var best *sharedServicePrincipal
+		for i := 0; i < role.SharedPrincipalCount; i++ {
+			sp, ok := byIndex[i]
+			if !ok || counts[sp.ResourceName] >= servicePrincipalKeyLimit {
+				continue
+			}
+			if best == nil || counts[sp.ResourceName] < counts[best.ResourceName] {
+				best = sp
+			}
+		}
+		if best != nil {
+			return best, nil
+		}
+
+		missing := -1
+		for i := 0; i < role.SharedPrincipalCount; i++ {
+			if _, ok := byIndex[i]; !ok {
+				missing = i
+				break
+			}
+		}
+		if missing < 0 {
+			return nil, logical.CodedError(http.StatusTooManyRequests, fmt.Sprintf(
+				"role %q has %d keys on each of its %d shared service principals, wait for existing credentials to expire or revoke them",
+				role.Name, servicePrincipalKeyLimit, role.SharedPrincipalCount))
+		}
+
+		if err := b.waitForServicePrincipalSlot(ctx, req, cl, 0); err != nil {
+			if wait <= 0 || !isQuotaExceeded(err) {
+				return nil, err
+			}
+
+			// wait without the role lock, then choose again as other
+			// requests may have changed the shards in the meantime
+			lock.Unlock()
+			err := b.waitForServicePrincipalSlot(ctx, req, cl, wait)
+			lock.Lock()
+			if err != nil {
+				return nil, err
+			}
+			wait = 0
+			continue
+		}
+
+		return b.createSharedServicePrincipal(ctx, req, cl, role, missing, logger)
+	}
+}
+
+// createSharedServicePrincipal creates the shard of the role at index and binds
+// it to the role's HCP role
+func (b *hcpBackend) createSharedServicePrincipal(ctx context.Context, req *logical.Request, cl *hcpClient, role *hcpRole, index int, logger hclog.Logger) (*sharedServicePrincipal, error) {
+	name := servicePrincipalName(role.Name, "shared", strconv.Itoa(index))
+	logger.Debug("creating shared service principal", "index", index)
+	sp, err := createServicePrincipal(ctx, req, cl, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := assignServicePrincipalRole(ctx, req, cl, sp, role.Role); err != nil {
+		// do not leave an unbound principal behind in the project
+		if delErr := deleteServicePrincipal(cl, sp); delErr != nil {
+			logger.Error("failed to delete unbound service principal", "service_principal", sp.ResourceName, "error", delErr)
+		}
+		return nil, err
+	}
+
+	shard := &sharedServicePrincipal{
+		Index:        index,
+		ID:           sp.ID,
+		ResourceName: sp.ResourceName,
+		Name:         name,
+		HCPRole:      role.Role,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := saveSharedServicePrincipal(ctx, req.Storage, role.Name, shard); err != nil {
+		return nil, err
+	}
+
+	logger.Info("created shared service principal", "index", index, "service_principal", sp.ResourceName)
+	return shard, nil
+}
+
+// rebindSharedServicePrincipals moves the shared service principals of a role
+// to its current HCP role
+func (b *hcpBackend) rebindSharedServicePrincipals(ctx context.Context, req *logical.Request, role *hcpRole) error {
+	shared, err := listSharedServicePrincipals(ctx, req.Storage, role.Name)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for _, sp := range shared {
+		if sp.HCPRole != role.Role {
+			ids = append(ids, sp.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	if err := rebindServicePrincipals(ctx, req, cl, role.Role, ids...); err != nil {
+		return err
+	}
+
+	for _, sp := range shared {
+		sp.HCPRole = role.Role
+		if err := saveSharedServicePrincipal(ctx, req.Storage, role.Name, sp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// destroySharedServicePrincipals deletes the shared service principals of a
+// role from the given shard index onwards, refusing while they have active keys
+func (b *hcpBackend) destroySharedServicePrincipals(ctx context.Context, req *logical.Request, role string, from int) error {
+	shared, err := listSharedServicePrincipals(ctx, req.Storage, role)
+	if err != nil {
+		return err
+	}
+
+	counts, err := sharedKeyCounts(ctx, req.Storage, role)
+	if err != nil {
+		return err
+	}
+
+	var cl *hcpClient
+	for _, sp := range shared {
+		if sp.Index < from {
+			continue
+		}
+
+		if counts[sp.ResourceName] > 0 {
+			return fmt.Errorf("shared service principal %q has %d active keys", sp.ResourceName, counts[sp.ResourceName])
+		}
+
+		if cl == nil {
+			if cl, err = b.getClient(ctx, req.Storage); err != nil {
+				return err
+			}
+		}
+
+		if err := deleteServicePrincipal(cl, &models.HashicorpCloudIamServicePrincipal{ResourceName: sp.ResourceName}); err != nil && !isNotFound(err) {
+			return err
+		}
+
+		if err := req.Storage.Delete(ctx, sharedStoragePrefix+role+"/"+strconv.Itoa(sp.Index)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package hcpsecrets
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestSharedPrincipalIssuance(t *testing.T) {
+	b, s := getTestBackend(t)
+	ctx := context.Background()
+
+	entry, err := logical.StorageEntryJSON("config", &hcpConfig{OrganizationID: "org", ProjectID: "project"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeServicePrincipalService()
+	b.client = &hcpClient{ServicePrincipals: fake, Project: &fakeProjectService{}}
+
+	role := &hcpRole{Name: "ci", Role: "viewer", Renewable: true, Mode: roleModeSharedPrincipal, SharedPrincipalCount: 2, Type: roleTypeServicePrincipal}
+	if err := saveRole(ctx, s, role); err != nil {
+		t.Fatal(err)
+	}
+
+	issue := func() (string, error) {
+		t.Helper()
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/ci",
+			Storage:   s,
+		})
+		if err != nil {
+			return "", err
+		}
+		if resp == nil || resp.IsError() || resp.Secret == nil {
+			t.Fatalf("got %v, want a credential", resp)
+		}
+		return resp.Secret.InternalData["service_principal"].(string), nil
+	}
+
+	// each shard is filled to the key limit before the next one is created
+	var principals []string
+	for i := 0; i < 2*servicePrincipalKeyLimit; i++ {
+		sp, err := issue()
+		if err != nil {
+			t.Fatalf("credential %d: %s", i, err)
+		}
+		principals = append(principals, sp)
+	}
+
+	if principals[0] != principals[1] || principals[2] != principals[3] || principals[0] == principals[2] {
+		t.Fatalf("got service principals %q, want two keys on each of two shards", principals)
+	}
+	for _, sp := range []string{principals[0], principals[2]} {
+		if n := fake.keyCount(sp); n != servicePrincipalKeyLimit {
+			t.Errorf("got %d keys on %q, want %d", n, sp, servicePrincipalKeyLimit)
+		}
+	}
+
+	shared, err := listSharedServicePrincipals(ctx, s, "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shared) != 2 {
+		t.Fatalf("got %d shared service principals, want 2", len(shared))
+	}
+
+	// with every shard full the request fails instead of creating a third shard
+	_, err = issue()
+	coded, ok := err.(logical.HTTPCodedError)
+	if !ok || coded.Code() != http.StatusTooManyRequests {
+		t.Fatalf("got error %v, want a 429 error", err)
+	}
+	if n := len(fake.principals); n != 2 {
+		t.Errorf("got %d service principals, want 2", n)
+	}
+}
+
+func TestAcquireSharedServicePrincipal(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// keys already on shards 0 and 1, including keys created outside Vault
+		keys      []int
+		wantIndex int
+	}{
+		{name: "least loaded shard", keys: []int{1, 0}, wantIndex: 1},
+		{name: "first shard on a tie", keys: []int{1, 1}, wantIndex: 0},
+		{name: "shard with room", keys: []int{0, 2}, wantIndex: 0},
+		{name: "keys created outside vault", keys: []int{2, 1}, wantIndex: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, s := getTestBackend(t)
+
+			fake := newFakeServicePrincipalService()
+			cl := &hcpClient{ServicePrincipals: fake}
+			role := &hcpRole{Name: "ci", Role: "viewer", Mode: roleModeSharedPrincipal, SharedPrincipalCount: 2}
+
+			for i, n := range tt.keys {
+				sp := fake.addPrincipal("project", "vault-ci-shared-"+strconv.Itoa(i), n)
+				if err := saveSharedServicePrincipal(ctx, s, "ci", &sharedServicePrincipal{
+					Index:        i,
+					ID:           sp.ID,
+					ResourceName: sp.ResourceName,
+					Name:         sp.Name,
+					HCPRole:      "viewer",
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			lock := locksutil.LockForKey(b.roleLocks, "ci")
+			lock.Lock()
+			defer lock.Unlock()
+
+			shard, err := b.acquireSharedServicePrincipal(ctx, &logical.Request{Storage: s}, cl, role, lock, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shard.Index != tt.wantIndex {
+				t.Errorf("got shard %d, want %d", shard.Index, tt.wantIndex)
+			}
+		})
+	}
+}
@@ -2,8 +2,10 @@ package hcpsecrets
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"strings"
 	"time"
 
 	models "github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/models"
@@ -12,24 +14,66 @@ import (
 
 	iam "github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/client/iam_service"
 	service_principals "github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/client/service_principals_service"
+	organization "github.com/hashicorp/hcp-sdk-go/clients/cloud-resource-manager/stable/2019-12-10/client/organization_service"
 	project "github.com/hashicorp/hcp-sdk-go/clients/cloud-resource-manager/stable/2019-12-10/client/project_service"
 )
 
-func createServicePrincipal(ctx context.Context, req *logical.Request, cl *hcpClient, role string) (*models.HashicorpCloudIamServicePrincipal, error) {
+// maximum length of a service principal name accepted by HCP
+const servicePrincipalNameMaxLen = 36
+
+// servicePrincipalName builds a unique service principal name from the role
+// name and any additional tags. Tags are kept whole where possible and the
+// role name is shortened to stay within the HCP length limit.
+func servicePrincipalName(role string, tags ...string) string {
+	suffix := fmt.Sprintf("%03d-%d", rand.Intn(1000), time.Now().Unix())
+
+	var extra string
+	for _, t := range tags {
+		if t = sanitizeNamePart(t); t != "" {
+			extra += "-" + t
+		}
+	}
+
+	// "v-" + role + extra + "-" + suffix
+	budget := servicePrincipalNameMaxLen - len("v-") - len("-") - len(suffix)
+	if len(extra) > budget-1 {
+		extra = strings.TrimRight(extra[:budget-1], "-")
+	}
+
+	role = sanitizeNamePart(role)
+	if max := budget - len(extra); len(role) > max {
+		role = strings.TrimRight(role[:max], "-")
+	}
+
+	return fmt.Sprintf("v-%s%s-%s", role, extra, suffix)
+}
+
+// sanitizeNamePart lowercases s and replaces characters HCP does not accept in names
+func sanitizeNamePart(s string) string {
+	s = strings.ToLower(s)
+	b := []byte(s)
+	for i, c := range b {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			b[i] = '-'
+		}
+	}
+	return strings.Trim(string(b), "-")
+}
+
+func createServicePrincipal(ctx context.Context, req *logical.Request, cl *hcpClient, name string) (*models.HashicorpCloudIamServicePrincipal, error) {
 	cfg, err := getConfig(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
 
-	// service principal name template
-	name := fmt.Sprintf("v-%s-%03d-%d", role, rand.Intn(1000), time.Now().Unix())
-	if len(name) > 36 {
-		name = name[:36]
-	}
+	return createProjectServicePrincipal(cl, cfg.ProjectID, name)
+}
 
+// createProjectServicePrincipal creates a service principal in the given project
+func createProjectServicePrincipal(cl *hcpClient, projectID string, name string) (*models.HashicorpCloudIamServicePrincipal, error) {
 	p := service_principals.NewServicePrincipalsServiceCreateServicePrincipalParams()
 	p.Body.Name = name
-	p.ParentResourceName = "project/" + cfg.ProjectID
+	p.ParentResourceName = "project/" + projectID
 
 	r, err := cl.ServicePrincipals.ServicePrincipalsServiceCreateServicePrincipal(p, nil)
 	if err != nil {
@@ -39,6 +83,64 @@ func createServicePrincipal(ctx context.Context, req *logical.Request, cl *hcpCl
 	return r.Payload.ServicePrincipal, nil
 }
 
+// listServicePrincipals returns every service principal in the configured project
+func listServicePrincipals(ctx context.Context, req *logical.Request, cl *hcpClient) ([]*models.HashicorpCloudIamServicePrincipal, error) {
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return listProjectServicePrincipals(cl, cfg.ProjectID)
+}
+
+// listProjectServicePrincipals returns every service principal in the given project
+func listProjectServicePrincipals(cl *hcpClient, projectID string) ([]*models.HashicorpCloudIamServicePrincipal, error) {
+	var principals []*models.HashicorpCloudIamServicePrincipal
+	var nextPageToken *string
+	for {
+		p := service_principals.NewServicePrincipalsServiceListServicePrincipalsParams()
+		p.ParentResourceName = "project/" + projectID
+		p.PaginationNextPageToken = nextPageToken
+
+		r, err := cl.ServicePrincipals.ServicePrincipalsServiceListServicePrincipals(p, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		principals = append(principals, r.Payload.ServicePrincipals...)
+
+		if r.Payload.Pagination == nil || r.Payload.Pagination.NextPageToken == "" {
+			return principals, nil
+		}
+		token := r.Payload.Pagination.NextPageToken
+		nextPageToken = &token
+	}
+}
+
+func getServicePrincipal(cl *hcpClient, resourceName string) (*models.HashicorpCloudIamServicePrincipal, error) {
+	p := service_principals.NewServicePrincipalsServiceGetServicePrincipalParams()
+	p.ResourceName = resourceName
+
+	r, err := cl.ServicePrincipals.ServicePrincipalsServiceGetServicePrincipal(p, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Payload.ServicePrincipal, nil
+}
+
+func listServicePrincipalKeys(cl *hcpClient, resourceName string) ([]*models.HashicorpCloudIamServicePrincipalKey, error) {
+	p := service_principals.NewServicePrincipalsServiceGetServicePrincipalParams()
+	p.ResourceName = resourceName
+
+	r, err := cl.ServicePrincipals.ServicePrincipalsServiceGetServicePrincipal(p, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Payload.Keys, nil
+}
+
 func createServicePrincipalKey(cl *hcpClient, s *models.HashicorpCloudIamServicePrincipal) (*models.HashicorpCloudIamCreateServicePrincipalKeyResponse, error) {
 	p := service_principals.NewServicePrincipalsServiceCreateServicePrincipalKeyParams()
 	p.ParentResourceName = s.ResourceName
@@ -71,6 +173,24 @@ func deleteServicePrincipalKey(cl *hcpClient, spk *models.HashicorpCloudIamServi
 	return nil
 }
 
+// deleteServicePrincipalAndKeys deletes the given keys of a service principal
+// and then the principal, treating resources that are already gone as deleted
+func deleteServicePrincipalAndKeys(cl *hcpClient, spResourceName string, keyResourceNames ...string) error {
+	for _, keyResourceName := range keyResourceNames {
+		spk := &models.HashicorpCloudIamServicePrincipalKey{ResourceName: keyResourceName}
+		if err := deleteServicePrincipalKey(cl, spk); err != nil && !isNotFound(err) {
+			return fmt.Errorf("error deleting service principal key: %w", err)
+		}
+	}
+
+	sp := &models.HashicorpCloudIamServicePrincipal{ResourceName: spResourceName}
+	if err := deleteServicePrincipal(cl, sp); err != nil && !isNotFound(err) {
+		return fmt.Errorf("error deleting service principal: %w", err)
+	}
+
+	return nil
+}
+
 // returns the current Service Principal and Service Principal Key used by the plugin
 func getCallerIdentity(ctx context.Context, req *logical.Request, cl *hcpClient) (*models.HashicorpCloudIamServicePrincipal, *models.HashicorpCloudIamServicePrincipalKey, error) {
 	cfg, err := getConfig(ctx, req.Storage)
@@ -110,9 +230,20 @@ func getCallerIdentity(ctx context.Context, req *logical.Request, cl *hcpClient)
 }
 
 func assignServicePrincipalRole(ctx context.Context, req *logical.Request, cl *hcpClient, sp *models.HashicorpCloudIamServicePrincipal, role string) error {
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	return assignProjectServicePrincipalRole(cl, cfg.ProjectID, sp, role)
+}
+
+// assignProjectServicePrincipalRole binds a service principal to a role in
+// the IAM policy of the given project
+func assignProjectServicePrincipalRole(cl *hcpClient, projectID string, sp *models.HashicorpCloudIamServicePrincipal, role string) error {
 	roleID := "roles/" + role
 
-	policy, err := getIAMPolicy(ctx, req, cl)
+	policy, err := getProjectIAMPolicy(cl, projectID)
 	if err != nil {
 		return err
 	}
@@ -143,23 +274,187 @@ func assignServicePrincipalRole(ctx context.Context, req *logical.Request, cl *h
 		policy.Bindings = append(policy.Bindings, binding)
 	}
 
-	if err := setIAMPolicy(ctx, req, cl, policy); err != nil {
+	if err := setProjectIAMPolicy(cl, projectID, policy); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func getIAMPolicy(ctx context.Context, req *logical.Request, cl *hcpClient) (*resourcemodels.HashicorpCloudResourcemanagerPolicy, error) {
+// removeProjectServicePrincipalRoles removes the given service principal IDs
+// from every binding of the IAM policy of the given project in a single policy update
+func removeProjectServicePrincipalRoles(cl *hcpClient, projectID string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	remove := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		remove[id] = struct{}{}
+	}
+
+	policy, err := getProjectIAMPolicy(cl, projectID)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	bindings := policy.Bindings[:0]
+	for _, binding := range policy.Bindings {
+		members := binding.Members[:0]
+		for _, member := range binding.Members {
+			if _, ok := remove[member.MemberID]; ok {
+				changed = true
+				continue
+			}
+			members = append(members, member)
+		}
+		binding.Members = members
+
+		// drop bindings left without members
+		if len(binding.Members) > 0 {
+			bindings = append(bindings, binding)
+		}
+	}
+	policy.Bindings = bindings
+
+	if !changed {
+		return nil
+	}
+
+	return setProjectIAMPolicy(cl, projectID, policy)
+}
+
+// rebindServicePrincipals moves the given service principal IDs from whatever
+// bindings they have in the project IAM policy to the given role, in a single
+// policy update
+func rebindServicePrincipals(ctx context.Context, req *logical.Request, cl *hcpClient, role string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
 	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	return rebindProjectServicePrincipals(cl, cfg.ProjectID, role, ids...)
+}
+
+// rebindProjectServicePrincipals moves the given service principal IDs to the
+// given role in the IAM policy of the given project
+func rebindProjectServicePrincipals(cl *hcpClient, projectID string, role string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	roleID := "roles/" + role
+
+	move := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		move[id] = struct{}{}
+	}
+
+	policy, err := getProjectIAMPolicy(cl, projectID)
+	if err != nil {
+		return err
+	}
+
+	var target *resourcemodels.HashicorpCloudResourcemanagerPolicyBinding
+	bindings := policy.Bindings[:0]
+	for _, binding := range policy.Bindings {
+		members := binding.Members[:0]
+		for _, member := range binding.Members {
+			if _, ok := move[member.MemberID]; !ok {
+				members = append(members, member)
+			}
+		}
+		binding.Members = members
+
+		if binding.RoleID == roleID {
+			target = binding
+		}
+
+		// drop bindings left without members, except the target role
+		if len(binding.Members) > 0 || binding.RoleID == roleID {
+			bindings = append(bindings, binding)
+		}
+	}
+	policy.Bindings = bindings
+
+	if target == nil {
+		target = &resourcemodels.HashicorpCloudResourcemanagerPolicyBinding{RoleID: roleID}
+		policy.Bindings = append(policy.Bindings, target)
+	}
+
+	for _, id := range ids {
+		target.Members = append(target.Members, &resourcemodels.HashicorpCloudResourcemanagerPolicyBindingMember{
+			MemberType: resourcemodels.HashicorpCloudResourcemanagerPolicyBindingMemberTypeSERVICEPRINCIPAL.Pointer(),
+			MemberID:   id,
+		})
+	}
+
+	return setProjectIAMPolicy(cl, projectID, policy)
+}
+
+// getCallerPrincipalID returns the ID of the service principal used by the plugin
+func getCallerPrincipalID(cl *hcpClient) (string, error) {
+	r, err := cl.IAM.IamServiceGetCallerIdentity(iam.NewIamServiceGetCallerIdentityParams(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	if r.Payload.Principal == nil || r.Payload.Principal.Service == nil {
+		return "", errors.New("caller is not a service principal")
+	}
+
+	return r.Payload.Principal.Service.ID, nil
+}
+
+// listProjects returns every project of the organization visible to the plugin
+func listProjects(cl *hcpClient, organizationID string) ([]*resourcemodels.HashicorpCloudResourcemanagerProject, error) {
+	scopeType := string(resourcemodels.HashicorpCloudResourcemanagerResourceIDResourceTypeORGANIZATION)
+
+	var projects []*resourcemodels.HashicorpCloudResourcemanagerProject
+	var nextPageToken *string
+	for {
+		p := project.NewProjectServiceListParams()
+		p.ScopeID = &organizationID
+		p.ScopeType = &scopeType
+		p.PaginationNextPageToken = nextPageToken
+
+		r, err := cl.Project.ProjectServiceList(p, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		projects = append(projects, r.Payload.Projects...)
+
+		if r.Payload.Pagination == nil || r.Payload.Pagination.NextPageToken == "" {
+			return projects, nil
+		}
+		token := r.Payload.Pagination.NextPageToken
+		nextPageToken = &token
+	}
+}
+
+func getProject(cl *hcpClient, projectID string) (*resourcemodels.HashicorpCloudResourcemanagerProject, error) {
+	p := project.NewProjectServiceGetParams()
+	p.ID = projectID
+
+	r, err := cl.Project.ProjectServiceGet(p, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	p := project.NewProjectServiceGetIamPolicyParams()
-	p.ID = cfg.ProjectID
+	return r.Payload.Project, nil
+}
 
-	r, err := cl.Project.ProjectServiceGetIamPolicy(p, nil)
+func getOrganizationIAMPolicy(cl *hcpClient, organizationID string) (*resourcemodels.HashicorpCloudResourcemanagerPolicy, error) {
+	p := organization.NewOrganizationServiceGetIamPolicyParams()
+	p.ID = organizationID
+
+	r, err := cl.Organization.OrganizationServiceGetIamPolicy(p, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -167,14 +462,46 @@ func getIAMPolicy(ctx context.Context, req *logical.Request, cl *hcpClient) (*re
 	return r.Payload.Policy, nil
 }
 
-func setIAMPolicy(ctx context.Context, req *logical.Request, cl *hcpClient, policy *resourcemodels.HashicorpCloudResourcemanagerPolicy) error {
-	cfg, err := getConfig(ctx, req.Storage)
+// policyRoles returns the role IDs a principal is bound to in a policy
+func policyRoles(policy *resourcemodels.HashicorpCloudResourcemanagerPolicy, principalID string) []string {
+	var roles []string
+	if policy == nil {
+		return roles
+	}
+
+	for _, binding := range policy.Bindings {
+		for _, member := range binding.Members {
+			if member.MemberID == principalID {
+				roles = append(roles, binding.RoleID)
+				break
+			}
+		}
+	}
+
+	return roles
+}
+
+// isNotFound reports whether err is an HCP API error with a 404 status
+func isNotFound(err error) bool {
+	var apiErr interface{ IsCode(int) bool }
+	return errors.As(err, &apiErr) && apiErr.IsCode(404)
+}
+
+func getProjectIAMPolicy(cl *hcpClient, projectID string) (*resourcemodels.HashicorpCloudResourcemanagerPolicy, error) {
+	p := project.NewProjectServiceGetIamPolicyParams()
+	p.ID = projectID
+
+	r, err := cl.Project.ProjectServiceGetIamPolicy(p, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	return r.Payload.Policy, nil
+}
+
+func setProjectIAMPolicy(cl *hcpClient, projectID string, policy *resourcemodels.HashicorpCloudResourcemanagerPolicy) error {
 	p := project.NewProjectServiceSetIamPolicyParams()
-	p.ID = cfg.ProjectID
+	p.ID = projectID
 	p.Body.Policy = policy
 
 	if _, err := cl.Project.ProjectServiceSetIamPolicy(p, nil); err != nil {
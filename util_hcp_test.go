@@ -0,0 +1,244 @@
+package hcpsecrets
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-openapi/runtime"
+	service_principals "github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/client/service_principals_service"
+	"github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/models"
+)
+
+// errNotFound is a 404 from the HCP API
+type errNotFound struct{}
+
+func (errNotFound) Error() string        { return "not found" }
+func (errNotFound) IsCode(code int) bool { return code == 404 }
+
+// fakeServicePrincipalService keeps service principals and their keys in
+// memory. Operations named in fail return the given error instead.
+type fakeServicePrincipalService struct {
+	service_principals.ClientService
+
+	mu         sync.Mutex
+	principals map[string]*models.HashicorpCloudIamServicePrincipal
+	keys       map[string][]*models.HashicorpCloudIamServicePrincipalKey
+	fail       map[string]error
+	next       int
+}
+
+func newFakeServicePrincipalService() *fakeServicePrincipalService {
+	return &fakeServicePrincipalService{
+		principals: map[string]*models.HashicorpCloudIamServicePrincipal{},
+		keys:       map[string][]*models.HashicorpCloudIamServicePrincipalKey{},
+		fail:       map[string]error{},
+	}
+}
+
+// addPrincipal adds a service principal with the given number of keys
+func (f *fakeServicePrincipalService) addPrincipal(projectID, name string, keys int) *models.HashicorpCloudIamServicePrincipal {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sp := f.createLocked(projectID, name)
+	for i := 0; i < keys; i++ {
+		f.createKeyLocked(sp.ResourceName)
+	}
+	return sp
+}
+
+func (f *fakeServicePrincipalService) createLocked(projectID, name string) *models.HashicorpCloudIamServicePrincipal {
+	f.next++
+	sp := &models.HashicorpCloudIamServicePrincipal{
+		ID:           fmt.Sprintf("sp-%d", f.next),
+		Name:         name,
+		ProjectID:    projectID,
+		ResourceName: "iam/project/" + projectID + "/service-principal/" + name,
+	}
+	f.principals[sp.ResourceName] = sp
+	return sp
+}
+
+func (f *fakeServicePrincipalService) createKeyLocked(spResourceName string) *models.HashicorpCloudIamServicePrincipalKey {
+	f.next++
+	key := &models.HashicorpCloudIamServicePrincipalKey{
+		ClientID:     fmt.Sprintf("client-%d", f.next),
+		ResourceName: fmt.Sprintf("%s/key/%d", spResourceName, f.next),
+	}
+	f.keys[spResourceName] = append(f.keys[spResourceName], key)
+	return key
+}
+
+// keyCount returns the number of keys of a service principal, or -1 if it does not exist
+func (f *fakeServicePrincipalService) keyCount(spResourceName string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.principals[spResourceName]; !ok {
+		return -1
+	}
+	return len(f.keys[spResourceName])
+}
+
+func (f *fakeServicePrincipalService) ServicePrincipalsServiceCreateServicePrincipal(params *service_principals.ServicePrincipalsServiceCreateServicePrincipalParams, _ runtime.ClientAuthInfoWriter, _ ...service_principals.ClientOption) (*service_principals.ServicePrincipalsServiceCreateServicePrincipalOK, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail["create_principal"]; err != nil {
+		return nil, err
+	}
+
+	sp := f.createLocked(strings.TrimPrefix(params.ParentResourceName, "project/"), params.Body.Name)
+	return &service_principals.ServicePrincipalsServiceCreateServicePrincipalOK{
+		Payload: &models.HashicorpCloudIamCreateServicePrincipalResponse{ServicePrincipal: sp},
+	}, nil
+}
+
+func (f *fakeServicePrincipalService) ServicePrincipalsServiceGetServicePrincipal(params *service_principals.ServicePrincipalsServiceGetServicePrincipalParams, _ runtime.ClientAuthInfoWriter, _ ...service_principals.ClientOption) (*service_principals.ServicePrincipalsServiceGetServicePrincipalOK, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sp, ok := f.principals[params.ResourceName]
+	if !ok {
+		return nil, errNotFound{}
+	}
+
+	return &service_principals.ServicePrincipalsServiceGetServicePrincipalOK{
+		Payload: &models.HashicorpCloudIamGetServicePrincipalResponse{ServicePrincipal: sp, Keys: f.keys[sp.ResourceName]},
+	}, nil
+}
+
+func (f *fakeServicePrincipalService) ServicePrincipalsServiceListServicePrincipals(params *service_principals.ServicePrincipalsServiceListServicePrincipalsParams, _ runtime.ClientAuthInfoWriter, _ ...service_principals.ClientOption) (*service_principals.ServicePrincipalsServiceListServicePrincipalsOK, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var principals []*models.HashicorpCloudIamServicePrincipal
+	for _, sp := range f.principals {
+		if "project/"+sp.ProjectID == params.ParentResourceName {
+			principals = append(principals, sp)
+		}
+	}
+
+	return &service_principals.ServicePrincipalsServiceListServicePrincipalsOK{
+		Payload: &models.HashicorpCloudIamListServicePrincipalsResponse{ServicePrincipals: principals},
+	}, nil
+}
+
+func (f *fakeServicePrincipalService) ServicePrincipalsServiceCreateServicePrincipalKey(params *service_principals.ServicePrincipalsServiceCreateServicePrincipalKeyParams, _ runtime.ClientAuthInfoWriter, _ ...service_principals.ClientOption) (*service_principals.ServicePrincipalsServiceCreateServicePrincipalKeyOK, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail["create_key"]; err != nil {
+		return nil, err
+	}
+	if _, ok := f.principals[params.ParentResourceName]; !ok {
+		return nil, errNotFound{}
+	}
+
+	return &service_principals.ServicePrincipalsServiceCreateServicePrincipalKeyOK{
+		Payload: &models.HashicorpCloudIamCreateServicePrincipalKeyResponse{
+			Key:          f.createKeyLocked(params.ParentResourceName),
+			ClientSecret: "secret",
+		},
+	}, nil
+}
+
+func (f *fakeServicePrincipalService) ServicePrincipalsServiceDeleteServicePrincipalKey(params *service_principals.ServicePrincipalsServiceDeleteServicePrincipalKeyParams, _ runtime.ClientAuthInfoWriter, _ ...service_principals.ClientOption) (*service_principals.ServicePrincipalsServiceDeleteServicePrincipalKeyOK, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail["delete_key"]; err != nil {
+		return nil, err
+	}
+
+	for sp, keys := range f.keys {
+		for i, key := range keys {
+			if key.ResourceName == params.ResourceName2 {
+				f.keys[sp] = append(keys[:i], keys[i+1:]...)
+				return &service_principals.ServicePrincipalsServiceDeleteServicePrincipalKeyOK{}, nil
+			}
+		}
+	}
+
+	return nil, errNotFound{}
+}
+
+func (f *fakeServicePrincipalService) ServicePrincipalsServiceDeleteServicePrincipal(params *service_principals.ServicePrincipalsServiceDeleteServicePrincipalParams, _ runtime.ClientAuthInfoWriter, _ ...service_principals.ClientOption) (*service_principals.ServicePrincipalsServiceDeleteServicePrincipalOK, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail["delete_principal"]; err != nil {
+		return nil, err
+	}
+	if _, ok := f.principals[params.ResourceName]; !ok {
+		return nil, errNotFound{}
+	}
+
+	delete(f.principals, params.ResourceName)
+	delete(f.keys, params.ResourceName)
+	return &service_principals.ServicePrincipalsServiceDeleteServicePrincipalOK{}, nil
+}
+
+func TestServicePrincipalName(t *testing.T) {
+	// "-" + three random digits + "-" + unix time
+	suffix := regexp.MustCompile(`-[0-9]{3}-[0-9]+$`)
+
+	tests := []struct {
+		name   string
+		role   string
+		tags   []string
+		prefix string
+	}{
+		{
+			name:   "short role",
+			role:   "packer",
+			prefix: "v-packer",
+		},
+		{
+			name:   "role and tag",
+			role:   "packer",
+			tags:   []string{"abc12345"},
+			prefix: "v-packer-abc12345",
+		},
+		{
+			name:   "invalid characters and empty tags",
+			role:   "My_Role",
+			tags:   []string{"", "INC 42", "--"},
+			prefix: "v-my-role-inc-42",
+		},
+		{
+			name:   "long role is shortened before tags",
+			role:   "a-very-long-role-name-for-testing",
+			tags:   []string{"abc12345"},
+			prefix: "v-a-very-lon-abc12345",
+		},
+		{
+			name:   "long tags are shortened from the end, keeping the role",
+			role:   "r",
+			tags:   []string{"abc12345", "ticket-1234567890", "purpose"},
+			prefix: "v-r-abc12345-ticket-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := servicePrincipalName(tt.role, tt.tags...)
+
+			if len(got) > servicePrincipalNameMaxLen {
+				t.Errorf("%q is longer than %d characters", got, servicePrincipalNameMaxLen)
+			}
+
+			loc := suffix.FindStringIndex(got)
+			if loc == nil {
+				t.Fatalf("%q does not end with a unique suffix", got)
+			}
+
+			if prefix := got[:loc[0]]; prefix != tt.prefix {
+				t.Errorf("got prefix %q, want %q", prefix, tt.prefix)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package hcpsecrets
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	vault "github.com/hashicorp/hcp-sdk-go/clients/cloud-vault-service/stable/2020-11-25/client/vault_service"
+)
+
+const secretTypeVaultAdminToken = "hcp-vault-admin-token"
+
+// HCP Vault Dedicated admin tokens are valid for six hours and cannot be renewed
+const vaultAdminTokenTTL = 6 * time.Hour
+
+func (b *hcpBackend) hcpVaultAdminToken() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeVaultAdminToken,
+		Fields: map[string]*framework.FieldSchema{
+			"token": {
+				Type:        framework.TypeString,
+				Description: "Admin token for the HCP Vault Dedicated cluster",
+			},
+		},
+		Revoke: b.revokeVaultAdminToken,
+	}
+}
+
+// issueVaultAdminToken generates an admin token for the role's HCP Vault
+// Dedicated cluster in the configured project
+func (b *hcpBackend) issueVaultAdminToken(ctx context.Context, req *logical.Request, cl *hcpClient, role *hcpRole, requestedTTL time.Duration, requester hcpRequester, logger hclog.Logger) (*logical.Response, error) {
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// a single admin token cannot be revoked, so the lease lasts exactly as
+	// long as the token and is refused rather than shortened
+	if requestedTTL != 0 && requestedTTL != vaultAdminTokenTTL {
+		return logical.ErrorResponse("ttl cannot be set on `vault_admin_token` roles, admin tokens are valid for %s", vaultAdminTokenTTL), nil
+	}
+	ttl, _, err := framework.CalculateTTL(b.System(), vaultAdminTokenTTL, vaultAdminTokenTTL, 0, role.leaseMaxTTL(), 0, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if ttl < vaultAdminTokenTTL {
+		return logical.ErrorResponse("the max TTL of %s is shorter than the %s admin tokens are valid for, which cannot be revoked early", ttl, vaultAdminTokenTTL), nil
+	}
+
+	logger = logger.With("cluster_id", role.ClusterID)
+
+	p := vault.NewGetAdminTokenParams()
+	p.ClusterID = role.ClusterID
+	p.LocationOrganizationID = cfg.OrganizationID
+	p.LocationProjectID = cfg.ProjectID
+
+	logger.Debug("generating vault admin token")
+	r, err := cl.Vault.GetAdminToken(p, nil)
+	if err != nil {
+		logger.Error("failed to generate vault admin token", "error", err)
+		return nil, err
+	}
+
+	logger.Info("issued vault admin token")
+
+	expiresAt := time.Now().UTC().Add(vaultAdminTokenTTL)
+	internalData := map[string]interface{}{
+		"vault_role": role.Name,
+		"cluster_id": role.ClusterID,
+		"expires_at": expiresAt.Format(time.RFC3339),
+	}
+	for k, v := range requester.internalData() {
+		internalData[k] = v
+	}
+
+	resp := b.Secret(secretTypeVaultAdminToken).Response(
+		// data
+		map[string]interface{}{
+			"token":      r.Payload.Token,
+			"cluster_id": role.ClusterID,
+		},
+		// internal data
+		internalData,
+	)
+
+	resp.Secret.TTL = vaultAdminTokenTTL
+	resp.Secret.MaxTTL = vaultAdminTokenTTL
+	resp.Secret.Renewable = false
+
+	return resp, nil
+}
+
+// revokeVaultAdminToken cannot revoke the token, as HCP can only revoke every
+// admin token of a cluster at once. A lease revoked before the token expires
+// is reported with a warning that the token is still valid.
+func (b *hcpBackend) revokeVaultAdminToken(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	logger := b.Logger().With("vault_role", req.Secret.InternalData["vault_role"], "cluster_id", req.Secret.InternalData["cluster_id"]).With(requesterFromInternalData(req.Secret.InternalData).logArgs()...)
+
+	expires, _ := req.Secret.InternalData["expires_at"].(string)
+	expiresAt, err := time.Parse(time.RFC3339, expires)
+	if err == nil && !time.Now().Before(expiresAt) {
+		logger.Info("vault admin token lease ended with the token")
+		return nil, nil
+	}
+
+	msg := "HCP cannot revoke a single vault admin token, the token stays valid until it expires"
+	if err == nil {
+		msg += " at " + expires
+	}
+	logger.Warn(msg)
+
+	resp := &logical.Response{}
+	resp.AddWarning(msg)
+	return resp, nil
+}
@@ -0,0 +1,218 @@
+package hcpsecrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/models"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	service_principals "github.com/hashicorp/hcp-sdk-go/clients/cloud-iam/stable/2019-12-10/client/service_principals_service"
+)
+
+const secretTypeWorkloadIdentity = "hcp-workload-identity"
+
+func (b *hcpBackend) hcpWorkloadIdentity() *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeWorkloadIdentity,
+		Fields: map[string]*framework.FieldSchema{
+			"workload_identity_provider": {
+				Type:        framework.TypeString,
+				Description: "Resource name of the workload identity provider to exchange external tokens with",
+			},
+			"service_principal": {
+				Type:        framework.TypeString,
+				Description: "Resource name of the service principal the provider is nested under",
+			},
+		},
+		Revoke: b.revokeWorkloadIdentity,
+		Renew:  b.renewCredentials,
+	}
+}
+
+func createWorkloadIdentityProvider(cl *hcpClient, sp *models.HashicorpCloudIamServicePrincipal, name string, role *hcpRole) (*models.HashicorpCloudIamWorkloadIdentityProvider, error) {
+	p := service_principals.NewServicePrincipalsServiceCreateWorkloadIdentityProviderParams()
+	p.ParentResourceName = sp.ResourceName
+	p.Body.Name = name
+	p.Body.Provider = &models.HashicorpCloudIamWorkloadIdentityProvider{
+		Description:       "Created by Vault role " + role.Name,
+		ConditionalAccess: role.OIDCConditionalAccess,
+		OidcConfig: &models.HashicorpCloudIamOIDCWorkloadIdentityProviderConfig{
+			IssuerURI:        role.OIDCIssuer,
+			AllowedAudiences: role.OIDCAudiences,
+		},
+	}
+
+	r, err := cl.ServicePrincipals.ServicePrincipalsServiceCreateWorkloadIdentityProvider(p, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Payload.Provider, nil
+}
+
+func deleteWorkloadIdentityProvider(cl *hcpClient, resourceName string) error {
+	p := service_principals.NewServicePrincipalsServiceDeleteWorkloadIdentityProviderParams()
+	p.ResourceName4 = resourceName
+
+	if _, err := cl.ServicePrincipals.ServicePrincipalsServiceDeleteWorkloadIdentityProvider(p, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// deleteWorkloadIdentityAndPrincipal deletes a workload identity provider and
+// then its service principal, treating resources that are already gone as deleted
+func deleteWorkloadIdentityAndPrincipal(cl *hcpClient, providerResourceName string, spResourceName string) error {
+	if providerResourceName != "" {
+		if err := deleteWorkloadIdentityProvider(cl, providerResourceName); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+
+	sp := &models.HashicorpCloudIamServicePrincipal{ResourceName: spResourceName}
+	if err := deleteServicePrincipal(cl, sp); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// issueWorkloadIdentity creates a service principal bound to the role's HCP
+// role and federates it with the role's OIDC issuer instead of creating a key
+func (b *hcpBackend) issueWorkloadIdentity(ctx context.Context, req *logical.Request, cl *hcpClient, role *hcpRole, ttl time.Duration, requester hcpRequester, logger hclog.Logger) (*logical.Response, error) {
+	logger.Debug("creating service principal")
+	spName := servicePrincipalName(role.Name, requester.nameTags()...)
+	sp, err := createServicePrincipal(ctx, req, cl, spName)
+	if err != nil {
+		logger.Error("failed to create service principal", "error", err)
+		return nil, err
+	}
+	logger = logger.With("service_principal", sp.ResourceName)
+
+	// do not leave an unusable principal behind if the rest of issuance fails
+	cleanup := func(providerResourceName string) {
+		if err := deleteWorkloadIdentityAndPrincipal(cl, providerResourceName, sp.ResourceName); err != nil {
+			logger.Error("failed to delete service principal after failed issuance", "error", err)
+		}
+	}
+
+	logger.Debug("assigning role to service principal")
+	if err := assignServicePrincipalRole(ctx, req, cl, sp, role.Role); err != nil {
+		logger.Error("failed to assign role to service principal", "error", err)
+		cleanup("")
+		return nil, err
+	}
+
+	logger.Debug("creating workload identity provider", "issuer", role.OIDCIssuer)
+	provider, err := createWorkloadIdentityProvider(cl, sp, spName, role)
+	if err != nil {
+		logger.Error("failed to create workload identity provider", "error", err)
+		cleanup("")
+		return nil, err
+	}
+
+	// there is no key, so the credential is recorded under the provider ID
+	if provider.ResourceID == "" {
+		logger.Error("workload identity provider has no ID", "workload_identity_provider", provider.ResourceName)
+		cleanup(provider.ResourceName)
+		return nil, fmt.Errorf("workload identity provider %q was created without an ID", provider.ResourceName)
+	}
+
+	issuedAt := time.Now().UTC()
+	cred := &hcpCredential{
+		ServicePrincipal:           sp.ResourceName,
+		ServicePrincipalName:       spName,
+		ServicePrincipalID:         sp.ID,
+		WorkloadIdentityProvider:   provider.ResourceName,
+		WorkloadIdentityProviderID: provider.ResourceID,
+		VaultRole:                  role.Name,
+		Requester:                  requester,
+		IssuedAt:                   issuedAt,
+		ExpiresAt:                  issuedAt.Add(ttl),
+		LeasePath:                  req.MountPoint + req.Path,
+	}
+	if err := saveCredential(ctx, req.Storage, cred); err != nil {
+		logger.Error("failed to save credential record", "error", err)
+		cleanup(provider.ResourceName)
+		return nil, err
+	}
+
+	logger.Info("issued workload identity provider", "workload_identity_provider", provider.ResourceName)
+
+	internalData := map[string]interface{}{
+		"vault_role":                    role.Name,
+		"workload_identity_provider":    provider.ResourceName,
+		"workload_identity_provider_id": provider.ResourceID,
+		"service_principal":             sp.ResourceName,
+		"service_principal_id":          sp.ID,
+	}
+	for k, v := range requester.internalData() {
+		internalData[k] = v
+	}
+
+	resp := b.Secret(secretTypeWorkloadIdentity).Response(
+		// data
+		map[string]interface{}{
+			"workload_identity_provider": provider.ResourceName,
+			"service_principal":          sp.ResourceName,
+			"issuer":                     role.OIDCIssuer,
+			"audiences":                  role.OIDCAudiences,
+		},
+		// internal data
+		internalData,
+	)
+
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = role.leaseMaxTTL()
+	resp.Secret.Renewable = role.Renewable
+
+	return resp, nil
+}
+
+func (b *hcpBackend) revokeWorkloadIdentity(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	providerResourceName, ok := req.Secret.InternalData["workload_identity_provider"].(string)
+	if !ok {
+		return nil, errors.New("internal data 'workload_identity_provider' not found")
+	}
+
+	spResourceName, ok := req.Secret.InternalData["service_principal"].(string)
+	if !ok {
+		return nil, errors.New("internal data 'service_principal' not found")
+	}
+
+	logger := b.Logger().With("vault_role", req.Secret.InternalData["vault_role"], "service_principal", spResourceName).With(requesterFromInternalData(req.Secret.InternalData).logArgs()...)
+
+	cl, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		logger.Error("failed to create HCP client", "error", err)
+		return nil, err
+	}
+
+	logger.Debug("deleting workload identity provider and service principal", "workload_identity_provider", providerResourceName)
+	if err := deleteWorkloadIdentityAndPrincipal(cl, providerResourceName, spResourceName); err != nil {
+		logger.Error("failed to revoke workload identity provider", "error", err)
+		return nil, err
+	}
+
+	if recordID, ok := recordIDFromInternalData(req.Secret.InternalData); ok {
+		cred := &hcpCredential{
+			WorkloadIdentityProviderID: recordID,
+			ServicePrincipal:           spResourceName,
+		}
+		cred.VaultRole, _ = req.Secret.InternalData["vault_role"].(string)
+
+		if err := deleteCredential(ctx, req.Storage, cred); err != nil {
+			logger.Error("failed to delete credential record", "workload_identity_provider_id", recordID, "error", err)
+			return nil, err
+		}
+	}
+
+	logger.Info("revoked workload identity provider")
+	return nil, nil
+}